@@ -0,0 +1,359 @@
+package zookeeper
+
+// This file defines administrative functions that talk to ZooKeeper
+// servers through their "four letter word" commands, rather than
+// through a client session.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrFourLetterWordNotAllowed is the error returned by FourLetterWord
+// when the server refuses to run the command because it is not listed
+// in its 4lw.commands.whitelist setting.
+var ErrFourLetterWordNotAllowed = errors.New("zookeeper: four letter word not in the server whitelist")
+
+// FourLetterWord sends the given four letter word command (such as
+// "ruok", "stat" or "dump") to the server at addr, and returns its
+// response.  The whole exchange must complete within timeout.
+func FourLetterWord(addr, word string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte(word)); err != nil {
+		return "", fmt.Errorf("zookeeper: cannot send %q: %v", word, err)
+	}
+	data, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("zookeeper: cannot read response to %q: %v", word, err)
+	}
+	response := string(data)
+	if strings.Contains(response, "is not executed because it is not in the whitelist") {
+		return "", ErrFourLetterWordNotAllowed
+	}
+	return response, nil
+}
+
+// SessionInfo holds information about a client session, as reported
+// by Sessions.
+type SessionInfo struct {
+	// Id is the session id.
+	Id int64
+
+	// Timeout is the negotiated session timeout, and Server is the
+	// address of the server the session is connected to.  They are
+	// only known for sessions connected to the queried server, and
+	// are empty for the others.
+	Timeout time.Duration
+	Server  string
+
+	// Ephemerals holds the paths of the ephemeral nodes owned by
+	// the session, sorted.
+	Ephemerals []string
+}
+
+// sessionsTimeout bounds each of the commands sent by Sessions.
+const sessionsTimeout = 10 * time.Second
+
+// Sessions returns the sessions known to the server at addr, sorted by
+// id, using the "cons" and "dump" four letter words.  The "cons" command
+// lists the sessions connected to the server itself, while "dump"
+// lists the ephemeral nodes of all sessions, but only when the server
+// is the ensemble leader or runs standalone.  If either command is not
+// whitelisted on the server, ErrFourLetterWordNotAllowed is returned.
+func Sessions(addr string) ([]SessionInfo, error) {
+	cons, err := FourLetterWord(addr, "cons", sessionsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	dump, err := FourLetterWord(addr, "dump", sessionsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return parseSessions(addr, cons, dump)
+}
+
+// parseSessions merges the sessions described by the output of the
+// "cons" and "dump" four letter words sent to the server at addr.
+func parseSessions(addr, cons, dump string) ([]SessionInfo, error) {
+	sessions := make(map[int64]*SessionInfo)
+	session := func(id int64) *SessionInfo {
+		info := sessions[id]
+		if info == nil {
+			info = &SessionInfo{Id: id}
+			sessions[id] = info
+		}
+		return info
+	}
+
+	// Each connection is described on a line such as:
+	//  /127.0.0.1:52614[1](queued=0,recved=5,sent=5,sid=0x100000abc,...,to=30000,...)
+	// Connections that haven't established a session yet have no sid.
+	for _, line := range strings.Split(cons, "\n") {
+		start := strings.Index(line, "(")
+		end := strings.LastIndex(line, ")")
+		if start < 0 || end < start {
+			continue
+		}
+		var id int64
+		var timeout time.Duration
+		found := false
+		for _, field := range strings.Split(line[start+1:end], ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "sid":
+				n, err := parseSessionId(kv[1])
+				if err != nil {
+					return nil, fmt.Errorf("zookeeper: bad session id in cons output: %q", line)
+				}
+				id, found = n, true
+			case "to":
+				n, err := strconv.ParseInt(kv[1], 10, 64)
+				if err != nil {
+					return nil, fmt.Errorf("zookeeper: bad session timeout in cons output: %q", line)
+				}
+				timeout = time.Duration(n) * time.Millisecond
+			}
+		}
+		if found {
+			info := session(id)
+			info.Timeout = timeout
+			info.Server = addr
+		}
+	}
+
+	// The ephemeral nodes follow the session sets in the dump, as in:
+	//
+	//   ephemeral nodes dump:
+	//   Sessions with Ephemerals (1):
+	//   0x100000abc:
+	//   	/test
+	//
+	// Servers that aren't the leader have no such section.
+	r := bufio.NewScanner(strings.NewReader(dump))
+	inEphemerals := false
+	var current *SessionInfo
+	for r.Scan() {
+		line := r.Text()
+		if !inEphemerals {
+			inEphemerals = strings.HasPrefix(line, "Sessions with Ephemerals")
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(trimmed, "/"):
+			if current == nil {
+				return nil, fmt.Errorf("zookeeper: ephemeral node without session in dump output: %q", line)
+			}
+			current.Ephemerals = append(current.Ephemerals, trimmed)
+		case strings.HasSuffix(trimmed, ":"):
+			id, err := parseSessionId(strings.TrimSuffix(trimmed, ":"))
+			if err != nil {
+				// Some other section has started.
+				inEphemerals = false
+				current = nil
+				continue
+			}
+			current = session(id)
+		default:
+			inEphemerals = false
+			current = nil
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]SessionInfo, 0, len(sessions))
+	for _, info := range sessions {
+		sort.Strings(info.Ephemerals)
+		result = append(result, *info)
+	}
+	sort.Sort(sessionsById(result))
+	return result, nil
+}
+
+// parseSessionId parses a session id in the hexadecimal
+// form used by the server, such as 0x100000abc.
+func parseSessionId(s string) (int64, error) {
+	if !strings.HasPrefix(s, "0x") {
+		return 0, fmt.Errorf("bad session id %q", s)
+	}
+	n, err := strconv.ParseUint(s[2:], 16, 64)
+	return int64(n), err
+}
+
+type sessionsById []SessionInfo
+
+func (s sessionsById) Len() int           { return len(s) }
+func (s sessionsById) Less(i, j int) bool { return s[i].Id < s[j].Id }
+func (s sessionsById) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// MemberStatus describes an ensemble member, as reported by its
+// "srvr" four letter word.
+type MemberStatus struct {
+	// Addr is the address the member was queried at.
+	Addr string
+
+	// Mode is the role of the member: "leader", "follower",
+	// "observer" or "standalone".
+	Mode string
+
+	// Zxid is the last transaction id seen by the member.
+	Zxid int64
+
+	// Err is the error that prevented querying the member, in
+	// which case the other fields are empty.
+	Err error
+}
+
+// Epoch returns the leader epoch of the member, which is
+// the high order half of its last zxid.
+func (m *MemberStatus) Epoch() int32 {
+	return int32(m.Zxid >> 32)
+}
+
+// EnsembleInfo holds the status of the members of an ensemble, and
+// how they relate to each other, as reported by EnsembleStatus.
+type EnsembleInfo struct {
+	// Members holds the status of each member, in the order the
+	// members were given.
+	Members []MemberStatus
+
+	// Leaders is the number of members acting as leader, and Leader
+	// is the address of the leader when there's exactly one.  A
+	// server running standalone counts as a leader.
+	Leaders int
+	Leader  string
+
+	// EpochsAgree is whether all the members that responded are in
+	// the same leader epoch, and ZxidSpread is the distance between
+	// the highest and lowest zxids they reported.  A small spread is
+	// expected while followers catch up with the leader.
+	EpochsAgree bool
+	ZxidSpread  int64
+
+	// SplitBrain is set when more than one leader was found or the
+	// epochs of the members diverge, which suggests the ensemble is
+	// partitioned.
+	SplitBrain bool
+}
+
+// ensembleTimeout bounds the command sent to each member by EnsembleStatus.
+const ensembleTimeout = 10 * time.Second
+
+// EnsembleStatus queries each of the ensemble members at the given
+// addresses with the "srvr" four letter word, and reports their mode
+// and last zxid, along with whether they agree on a single leader.
+// Members that can't be queried have Err set in their MemberStatus,
+// and are otherwise ignored.  An error is returned only if none of
+// them could be queried.
+func EnsembleStatus(servers []string) (*EnsembleInfo, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("zookeeper: no ensemble members given")
+	}
+	members := make([]MemberStatus, len(servers))
+	done := make(chan bool)
+	for i, addr := range servers {
+		go func(member *MemberStatus, addr string) {
+			member.Addr = addr
+			output, err := FourLetterWord(addr, "srvr", ensembleTimeout)
+			if err == nil {
+				member.Mode, member.Zxid, err = parseServerStatus(output)
+			}
+			if err != nil {
+				*member = MemberStatus{Addr: addr, Err: err}
+			}
+			done <- true
+		}(&members[i], addr)
+	}
+	for range servers {
+		<-done
+	}
+	return reconcileEnsemble(members)
+}
+
+// parseServerStatus extracts the mode and the zxid
+// from the output of the "srvr" four letter word.
+func parseServerStatus(output string) (mode string, zxid int64, err error) {
+	foundZxid := false
+	for _, line := range strings.Split(output, "\n") {
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(kv[1])
+		switch kv[0] {
+		case "Mode":
+			mode = value
+		case "Zxid":
+			n, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 64)
+			if err != nil {
+				return "", 0, fmt.Errorf("zookeeper: bad zxid in srvr output: %q", line)
+			}
+			zxid, foundZxid = int64(n), true
+		}
+	}
+	if mode == "" || !foundZxid {
+		// Servers not serving requests, as while an election is
+		// ongoing, say so instead of reporting their status.
+		return "", 0, fmt.Errorf("zookeeper: unexpected srvr output: %q", strings.TrimSpace(output))
+	}
+	return mode, zxid, nil
+}
+
+// reconcileEnsemble puts together the status of the ensemble
+// from the status of its members.
+func reconcileEnsemble(members []MemberStatus) (*EnsembleInfo, error) {
+	status := &EnsembleInfo{Members: members, EpochsAgree: true}
+	var responded []*MemberStatus
+	for i := range members {
+		member := &members[i]
+		if member.Err != nil {
+			continue
+		}
+		responded = append(responded, member)
+		if member.Mode == "leader" || member.Mode == "standalone" {
+			status.Leaders++
+			status.Leader = member.Addr
+		}
+	}
+	if len(responded) == 0 {
+		return nil, fmt.Errorf("zookeeper: no ensemble member responded: %v", members[0].Err)
+	}
+	if status.Leaders != 1 {
+		status.Leader = ""
+	}
+	min, max := responded[0].Zxid, responded[0].Zxid
+	for _, member := range responded[1:] {
+		if member.Epoch() != responded[0].Epoch() {
+			status.EpochsAgree = false
+		}
+		if member.Zxid < min {
+			min = member.Zxid
+		}
+		if member.Zxid > max {
+			max = member.Zxid
+		}
+	}
+	status.ZxidSpread = max - min
+	status.SplitBrain = status.Leaders > 1 || !status.EpochsAgree
+	return status, nil
+}
@@ -0,0 +1,153 @@
+package zookeeper_test
+
+import (
+	"errors"
+	. "launchpad.net/gocheck"
+	zk "github.com/Shopify/gozk"
+	"strings"
+	"time"
+)
+
+var sessionsCons = ` /127.0.0.1:52614[1](queued=0,recved=5,sent=5,sid=0x100000abc,lop=PING,est=1600000000000,to=30000,lcxid=0x1,lzxid=0x5,lresp=1600000000000,llat=0,minlat=0,avglat=0,maxlat=0)
+ /127.0.0.1:52616[1](queued=0,recved=3,sent=3,sid=0x100000abd,lop=PING,est=1600000000000,to=4000,lcxid=0x0,lzxid=0x5,lresp=1600000000000,llat=0,minlat=0,avglat=0,maxlat=0)
+ /127.0.0.1:52618[0](queued=0,recved=1,sent=0)
+
+`
+
+var sessionsDump = `SessionTracker dump:
+Session Sets (2):
+0 expire at Thu Jan 01 00:00:00 UTC 1970:
+2 expire at Sun Sep 13 12:26:40 UTC 2020:
+	0x100000abc
+	0x100000abd
+ephemeral nodes dump:
+Sessions with Ephemerals (2):
+0x100000abc:
+	/services/b
+	/services/a
+0x100000abe:
+	/other
+Connections dump:
+Connections Sets (1)/(1):
+0 expire at Thu Jan 01 00:00:00 UTC 1970:
+`
+
+func (s *S) TestParseSessions(c *C) {
+	sessions, err := zk.ParseSessions("10.0.0.1:2181", sessionsCons, sessionsDump)
+	c.Assert(err, IsNil)
+	c.Assert(sessions, DeepEquals, []zk.SessionInfo{{
+		Id:         0x100000abc,
+		Timeout:    30 * time.Second,
+		Server:     "10.0.0.1:2181",
+		Ephemerals: []string{"/services/a", "/services/b"},
+	}, {
+		Id:      0x100000abd,
+		Timeout: 4 * time.Second,
+		Server:  "10.0.0.1:2181",
+	}, {
+		Id:         0x100000abe,
+		Ephemerals: []string{"/other"},
+	}})
+
+	_, err = zk.ParseSessions("10.0.0.1:2181", " /127.0.0.1:1[1](sid=bogus)\n", "")
+	c.Assert(err, ErrorMatches, `zookeeper: bad session id in cons output: .*`)
+}
+
+func (s *S) TestSessions(c *C) {
+	conn, _ := s.init(c)
+
+	_, err := conn.Create("/test", "", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+
+	sessions, err := zk.Sessions(s.zkAddr)
+	if err == zk.ErrFourLetterWordNotAllowed {
+		c.Skip("cons and dump are not whitelisted on the test server")
+	}
+	c.Assert(err, IsNil)
+
+	id := conn.ClientId().SessionId()
+	for _, session := range sessions {
+		if session.Id == id {
+			c.Assert(session.Timeout > 0, Equals, true)
+			c.Assert(session.Server, Equals, s.zkAddr)
+			c.Assert(session.Ephemerals, DeepEquals, []string{"/test"})
+			return
+		}
+	}
+	c.Fatalf("session %#x not found in %v", id, sessions)
+}
+
+var srvrOutput = `Zookeeper version: 3.6.2--803c7f1a12f85978cb049af5e4ef23bd8b688715, built on 09/04/2020 12:44 GMT
+Latency min/avg/max: 0/0.0/0
+Received: 4
+Sent: 3
+Connections: 1
+Outstanding: 0
+Zxid: 0x200000007
+Mode: follower
+Node count: 5
+`
+
+func (s *S) TestParseServerStatus(c *C) {
+	mode, zxid, err := zk.ParseServerStatus(srvrOutput)
+	c.Assert(err, IsNil)
+	c.Assert(mode, Equals, "follower")
+	c.Assert(zxid, Equals, int64(0x200000007))
+
+	_, _, err = zk.ParseServerStatus("This ZooKeeper instance is not currently serving requests\n")
+	c.Assert(err, ErrorMatches, `zookeeper: unexpected srvr output: "This ZooKeeper instance is not currently serving requests"`)
+
+	_, _, err = zk.ParseServerStatus("Zxid: bogus\nMode: leader\n")
+	c.Assert(err, ErrorMatches, `zookeeper: bad zxid in srvr output: "Zxid: bogus"`)
+}
+
+func (s *S) TestReconcileEnsemble(c *C) {
+	down := errors.New("connection refused")
+	status, err := zk.ReconcileEnsemble([]zk.MemberStatus{
+		{Addr: "a:2181", Mode: "follower", Zxid: 0x200000005},
+		{Addr: "b:2181", Mode: "leader", Zxid: 0x200000007},
+		{Addr: "c:2181", Err: down},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status.Leaders, Equals, 1)
+	c.Assert(status.Leader, Equals, "b:2181")
+	c.Assert(status.EpochsAgree, Equals, true)
+	c.Assert(status.ZxidSpread, Equals, int64(2))
+	c.Assert(status.SplitBrain, Equals, false)
+	c.Assert(status.Members[2].Err, Equals, down)
+
+	// Two leaders.
+	status, err = zk.ReconcileEnsemble([]zk.MemberStatus{
+		{Addr: "a:2181", Mode: "leader", Zxid: 0x200000005},
+		{Addr: "b:2181", Mode: "leader", Zxid: 0x200000007},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status.Leaders, Equals, 2)
+	c.Assert(status.Leader, Equals, "")
+	c.Assert(status.SplitBrain, Equals, true)
+
+	// A single leader, but divergent epochs.
+	status, err = zk.ReconcileEnsemble([]zk.MemberStatus{
+		{Addr: "a:2181", Mode: "follower", Zxid: 0x100000009},
+		{Addr: "b:2181", Mode: "leader", Zxid: 0x200000001},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(status.Leader, Equals, "b:2181")
+	c.Assert(status.EpochsAgree, Equals, false)
+	c.Assert(status.SplitBrain, Equals, true)
+
+	_, err = zk.ReconcileEnsemble([]zk.MemberStatus{{Addr: "a:2181", Err: down}})
+	c.Assert(err, ErrorMatches, "zookeeper: no ensemble member responded: connection refused")
+}
+
+func (s *S) TestEnsembleStatus(c *C) {
+	status, err := zk.EnsembleStatus([]string{s.zkAddr})
+	if err != nil && strings.Contains(err.Error(), zk.ErrFourLetterWordNotAllowed.Error()) {
+		c.Skip("srvr is not whitelisted on the test server")
+	}
+	c.Assert(err, IsNil)
+	c.Assert(status.Members, HasLen, 1)
+	c.Assert(status.Members[0].Mode, Equals, "standalone")
+	c.Assert(status.Leader, Equals, s.zkAddr)
+	c.Assert(status.SplitBrain, Equals, false)
+}
@@ -134,6 +134,176 @@ func (s *S) TestConcurrentClose(c *C) {
 	}
 }
 
+func (s *S) TestCloseTimeout(c *C) {
+	p := newProxy(c, s.zkAddr)
+	defer p.close()
+	conn, watch, err := zk.Dial(p.addr(), 5e9)
+	c.Assert(err, IsNil)
+	c.Assert((<-watch).Ok(), Equals, true)
+
+	_, existsWatch, err := conn.ExistsW("/nothing")
+	c.Assert(err, IsNil)
+
+	// The server reply to the close request is held back,
+	// so zookeeper_close can't return in time.
+	p.stopIncoming()
+	err = conn.CloseTimeout(0.1e9)
+	c.Check(zk.IsError(err, zk.ZOPERATIONTIMEOUT), Equals, true, Commentf("%v", err))
+	p.startIncoming()
+
+	event := <-existsWatch
+	c.Assert(event.State, Equals, zk.STATE_CLOSED)
+	c.Assert(event.CloseReason, Equals, zk.CLOSE_CONNECTION)
+	c.Assert(zk.CountPendingWatches(), Equals, 0)
+
+	err = conn.CloseTimeout(0.1e9)
+	c.Check(zk.IsError(err, zk.ZCLOSING), Equals, true, Commentf("%v", err))
+}
+
+func (s *S) TestCloseTimeoutInTime(c *C) {
+	conn, watch, err := zk.Dial(s.zkAddr, 5e9)
+	c.Assert(err, IsNil)
+	c.Assert((<-watch).Ok(), Equals, true)
+
+	err = conn.CloseTimeout(5e9)
+	c.Assert(err, IsNil)
+
+	_, ok := <-watch
+	c.Assert(ok, Equals, true)
+	_, ok = <-watch
+	c.Assert(ok, Equals, false)
+}
+
+func (s *S) TestCloseDuringConcurrentRequests(c *C) {
+	conn, watch, err := zk.Dial(s.zkAddr, 5e9)
+	c.Assert(err, IsNil)
+	c.Assert((<-watch).Ok(), Equals, true)
+
+	_, err = conn.Create("/closetest", "data", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+
+	// Hammer the connection from many goroutines while it's
+	// closed underneath them.  Every request must either succeed
+	// or fail cleanly with ZCLOSING, and none may touch the
+	// freed handle.
+	const workers = 50
+	done := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				_, _, err := conn.Get("/closetest")
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(0.1e9)
+	c.Assert(conn.Close(), IsNil)
+
+	for i := 0; i < workers; i++ {
+		select {
+		case err := <-done:
+			c.Check(zk.IsError(err, zk.ZCLOSING), Equals, true, Commentf("%v", err))
+		case <-time.After(5e9):
+			c.Fatalf("timeout waiting for request goroutines")
+		}
+	}
+	c.Assert(conn.ClientId(), IsNil)
+	c.Assert(conn.ConnectedServer(), Equals, "")
+
+	conn, _ = s.init(c)
+	err = conn.Delete("/closetest", -1)
+	c.Assert(err, IsNil)
+}
+
+// closedFuncs holds operations besides those in requestFuncs
+// that must fail cleanly with ZCLOSING once the connection is closed.
+var closedFuncs = []func(conn *zk.Conn, path string) error{
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.CurrentServer()
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		return conn.ExpireSession()
+	},
+	func(conn *zk.Conn, path string) error {
+		return conn.AddAuth("digest", "joe:passwd")
+	},
+	func(conn *zk.Conn, path string) error {
+		_, _, err := conn.GetWithCallback(path, func(zk.Event) {})
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, _, err := conn.ChildrenWithCallback(path, func(zk.Event) {})
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.ExistsWithCallback(path, func(zk.Event) {})
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, _, _, err := conn.GetWithChildren(path)
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.CreateChecked(path, "", 0, zk.WorldACL(zk.PERM_ALL))
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		return conn.DeleteChecked(path, -1)
+	},
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.NewTransaction().Check(path, -1).Commit()
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.AddWatch(path, zk.ADD_WATCH_PERSISTENT)
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.WatchChildren(path)
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.Observe(path)
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.WatchTree(path)
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, err := conn.Ping()
+		return err
+	},
+	func(conn *zk.Conn, path string) error {
+		_, _, err := conn.NewCache().Get(path)
+		return err
+	},
+}
+
+func (s *S) TestOperationsAfterClose(c *C) {
+	conn, watch, err := zk.Dial(s.zkAddr, 5e9)
+	c.Assert(err, IsNil)
+	c.Assert((<-watch).Ok(), Equals, true)
+	c.Assert(conn.Close(), IsNil)
+
+	for i, f := range append(requestFuncs, closedFuncs...) {
+		err := f(conn, "/closetest")
+		c.Check(zk.IsError(err, zk.ZCLOSING), Equals, true, Commentf("func %d: %v", i, err))
+	}
+
+	// Methods that can't fail must not crash either.
+	conn.SetServersResolutionDelay(0)
+	conn.SetServers(s.zkAddr)
+	c.Check(conn.ConnectedServer(), Equals, "")
+	c.Check(conn.ClientId(), IsNil)
+	c.Check(zk.IsError(conn.Close(), zk.ZCLOSING), Equals, true)
+	c.Check(zk.CountPendingWatches(), Equals, 0)
+}
+
 type proxy struct {
 	stop, start chan bool
 	listener    net.Listener
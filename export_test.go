@@ -0,0 +1,58 @@
+package zookeeper
+
+import "time"
+
+// SystemClassPath exposes systemClassPath for testing.
+var SystemClassPath = systemClassPath
+
+// ParseSessions exposes parseSessions for testing.
+var ParseSessions = parseSessions
+
+// ParseServerStatus exposes parseServerStatus for testing.
+var ParseServerStatus = parseServerStatus
+
+// ReconcileEnsemble exposes reconcileEnsemble for testing.
+var ReconcileEnsemble = reconcileEnsemble
+
+// FindMember exposes findMember for testing.
+var FindMember = findMember
+
+// EnsembleReady exposes ensembleReady for testing.
+var EnsembleReady = ensembleReady
+
+// InstallDirs exposes installDirs for testing.
+var InstallDirs = &installDirs
+
+// SendSessionEvent delivers event to the session channel of conn,
+// as if it had been received from the C library.
+func SendSessionEvent(conn *Conn, event Event) {
+	sendEvent(conn.sessionWatchId, event)
+}
+
+// CreateMode exposes createMode for testing.
+func CreateMode(flags int, ttl time.Duration) (int, error) {
+	return createMode(flags, ttl, "create", "/path")
+}
+
+// RecordBreakerResult feeds the circuit breaker of conn with
+// the result of an operation, as if it had been attempted.
+func RecordBreakerResult(conn *Conn, err error) {
+	conn.breaker.record(err)
+}
+
+// BreakerAllow asks the circuit breaker of conn
+// whether an operation may be attempted.
+func BreakerAllow(conn *Conn) error {
+	return conn.breaker.allow()
+}
+
+// ServerCommand exposes Server.command for testing.
+func ServerCommand(srv *Server) ([]string, error) {
+	return srv.command()
+}
+
+// StatWithOwner returns a Stat with the given ephemeralOwner field.
+func StatWithOwner(owner int64) *Stat {
+	f := statFields{ephemeralOwner: owner}
+	return f.stat()
+}
@@ -0,0 +1,429 @@
+package zookeeper
+
+// This file defines ConnInterface, the methods of Conn most code
+// depends on, and FakeConn, an in-memory implementation of it for
+// testing such code without running a ZooKeeper server.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConnInterface holds the methods of Conn which read and change nodes,
+// and watch them for changes.  Code depending on ConnInterface rather
+// than on *Conn may be tested with a FakeConn.
+type ConnInterface interface {
+	Get(path string) (data string, stat *Stat, err error)
+	GetW(path string) (data string, stat *Stat, watch <-chan Event, err error)
+	Children(path string) (children []string, stat *Stat, err error)
+	ChildrenW(path string) (children []string, stat *Stat, watch <-chan Event, err error)
+	Exists(path string) (stat *Stat, err error)
+	ExistsW(path string) (stat *Stat, watch <-chan Event, err error)
+	Create(path, value string, flags int, aclv []ACL) (pathCreated string, err error)
+	Set(path, value string, version int) (stat *Stat, err error)
+	Delete(path string, version int) (err error)
+	Close() error
+}
+
+var (
+	_ ConnInterface = (*Conn)(nil)
+	_ ConnInterface = (*FakeConn)(nil)
+)
+
+// FakeConn is an in-memory implementation of ConnInterface, modeling a
+// tree of nodes as a ZooKeeper server would: node versions, ephemeral
+// nodes owned by the session of the FakeConn that created them,
+// sequential nodes, and watches firing once with the same events a
+// real connection delivers.  Several sessions may share the same tree,
+// as obtained with NewSession.
+//
+// ACLs are validated but not enforced, and the session never loses its
+// connection, so the only session events are the initial STATE_CONNECTED
+// one and the final EVENT_CLOSED one delivered on Close.
+type FakeConn struct {
+	tree    *fakeTree
+	session int64
+	events  chan Event
+	closed  bool
+}
+
+// fakeTree holds the nodes shared by the sessions of FakeConn values.
+// All of its state, including that of the sessions, is guarded by mutex.
+type fakeTree struct {
+	mutex        sync.Mutex
+	nodes        map[string]*fakeNode
+	zxid         int64
+	lastSession  int64
+	dataWatches  map[string][]fakeWatch
+	childWatches map[string][]fakeWatch
+}
+
+type fakeNode struct {
+	data     string
+	stat     statFields
+	children map[string]bool
+}
+
+type fakeWatch struct {
+	conn *FakeConn
+	ch   chan Event
+}
+
+// NewFakeConn returns a FakeConn with a session on a new tree of nodes,
+// holding just the root node and the /zookeeper node, along with its
+// session event channel, as Dial does.
+func NewFakeConn() (*FakeConn, <-chan Event) {
+	tree := &fakeTree{
+		nodes:        make(map[string]*fakeNode),
+		dataWatches:  make(map[string][]fakeWatch),
+		childWatches: make(map[string][]fakeWatch),
+	}
+	tree.nodes["/"] = &fakeNode{children: make(map[string]bool)}
+	tree.create("/zookeeper", "", 0)
+	return tree.newSession()
+}
+
+// NewSession returns a FakeConn with a new session on the
+// same tree of nodes as fc, along with its session event channel.
+func (fc *FakeConn) NewSession() (*FakeConn, <-chan Event) {
+	return fc.tree.newSession()
+}
+
+// SessionId returns the id of the session of fc, as found in
+// the EphemeralOwner of the nodes it created.
+func (fc *FakeConn) SessionId() int64 {
+	return fc.session
+}
+
+func (tree *fakeTree) newSession() (*FakeConn, <-chan Event) {
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	tree.lastSession++
+	fc := &FakeConn{tree: tree, session: tree.lastSession, events: make(chan Event, 32)}
+	fc.events <- Event{Type: EVENT_SESSION, State: STATE_CONNECTED}
+	return fc, fc.events
+}
+
+// Close terminates the session of fc, deleting its ephemeral nodes
+// and closing its watches and session event channel, with a final
+// EVENT_CLOSED event as with a real connection.
+func (fc *FakeConn) Close() error {
+	tree := fc.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	if fc.closed {
+		return closingError("close", "")
+	}
+	fc.closed = true
+
+	closed := Event{Type: EVENT_CLOSED, State: STATE_CLOSED, CloseReason: CLOSE_CONNECTION}
+	for _, watches := range []map[string][]fakeWatch{tree.dataWatches, tree.childWatches} {
+		for path, list := range watches {
+			kept := list[:0]
+			for _, w := range list {
+				if w.conn == fc {
+					w.ch <- closed
+					close(w.ch)
+				} else {
+					kept = append(kept, w)
+				}
+			}
+			watches[path] = kept
+		}
+	}
+	fc.events <- closed
+	close(fc.events)
+
+	var ephemerals []string
+	for path, node := range tree.nodes {
+		if node.stat.ephemeralOwner == fc.session {
+			ephemerals = append(ephemerals, path)
+		}
+	}
+	sort.Strings(ephemerals)
+	for _, path := range ephemerals {
+		tree.delete(path)
+	}
+	return nil
+}
+
+// Get returns the data and status of the node at path.
+func (fc *FakeConn) Get(path string) (data string, stat *Stat, err error) {
+	data, stat, _, err = fc.get("get", path, false)
+	return
+}
+
+// GetW works like Get, but also returns a channel that receives a
+// single event when the node changes or is deleted.
+func (fc *FakeConn) GetW(path string) (data string, stat *Stat, watch <-chan Event, err error) {
+	return fc.get("getw", path, true)
+}
+
+func (fc *FakeConn) get(op, path string, watch bool) (string, *Stat, <-chan Event, error) {
+	tree := fc.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	node, err := fc.node(op, path)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var ch <-chan Event
+	if watch {
+		ch = tree.watch(tree.dataWatches, fc, path)
+	}
+	return node.data, node.stat.stat(), ch, nil
+}
+
+// Children returns the names of the children of the node
+// at path, sorted, and the status of the node.
+func (fc *FakeConn) Children(path string) (children []string, stat *Stat, err error) {
+	children, stat, _, err = fc.children("children", path, false)
+	return
+}
+
+// ChildrenW works like Children, but also returns a channel that
+// receives a single event when a child is created or deleted, or
+// when the node itself is deleted.
+func (fc *FakeConn) ChildrenW(path string) (children []string, stat *Stat, watch <-chan Event, err error) {
+	return fc.children("childrenw", path, true)
+}
+
+func (fc *FakeConn) children(op, path string, watch bool) ([]string, *Stat, <-chan Event, error) {
+	tree := fc.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	node, err := fc.node(op, path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	children := make([]string, 0, len(node.children))
+	for name := range node.children {
+		children = append(children, name)
+	}
+	sort.Strings(children)
+	var ch <-chan Event
+	if watch {
+		ch = tree.watch(tree.childWatches, fc, path)
+	}
+	return children, node.stat.stat(), ch, nil
+}
+
+// Exists returns the status of the node at path,
+// or nil if it doesn't exist.
+func (fc *FakeConn) Exists(path string) (stat *Stat, err error) {
+	stat, _, err = fc.exists("exists", path, false)
+	return
+}
+
+// ExistsW works like Exists, but also returns a channel that receives
+// a single event when the node is created, changed or deleted.
+func (fc *FakeConn) ExistsW(path string) (stat *Stat, watch <-chan Event, err error) {
+	return fc.exists("existsw", path, true)
+}
+
+func (fc *FakeConn) exists(op, path string, watch bool) (*Stat, <-chan Event, error) {
+	tree := fc.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	node, err := fc.node(op, path)
+	if err != nil && !IsError(err, ZNONODE) {
+		return nil, nil, err
+	}
+	var stat *Stat
+	if node != nil {
+		stat = node.stat.stat()
+	}
+	var ch <-chan Event
+	if watch {
+		ch = tree.watch(tree.dataWatches, fc, path)
+	}
+	return stat, ch, nil
+}
+
+// Create creates a node at path, as Conn.Create does.  The EPHEMERAL
+// and SEQUENCE flags are honored, and CONTAINER nodes are created as
+// persistent nodes that are never deleted automatically.
+func (fc *FakeConn) Create(path, value string, flags int, aclv []ACL) (pathCreated string, err error) {
+	tree := fc.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	if fc.closed {
+		return "", closingError("create", path)
+	}
+	checked := path
+	if flags&SEQUENCE != 0 {
+		// The sequence number completes the last element.
+		checked += "0"
+	}
+	if err := validatePath("create", checked); err != nil {
+		err.(*Error).Path = path
+		return "", err
+	}
+	if _, err := createMode(flags, 0, "create", path); err != nil {
+		return "", err
+	}
+	if aclv == nil {
+		aclv = WorldACL(PERM_ALL)
+	}
+	if err := validateACL(aclv, "create", path); err != nil {
+		return "", err
+	}
+	if path == "/" {
+		return "", &Error{Op: "create", Code: ZNODEEXISTS, Path: path}
+	}
+	parent := tree.nodes[fakeParent(path)]
+	if parent == nil {
+		return "", &Error{Op: "create", Code: ZNONODE, Path: path}
+	}
+	if parent.stat.ephemeralOwner != 0 {
+		return "", &Error{Op: "create", Code: ZNOCHILDRENFOREPHEMERALS, Path: path}
+	}
+	if flags&SEQUENCE != 0 {
+		path += FormatSequence(int64(parent.stat.cversion))
+	}
+	if tree.nodes[path] != nil {
+		return "", &Error{Op: "create", Code: ZNODEEXISTS, Path: path}
+	}
+	var owner int64
+	if flags&EPHEMERAL != 0 {
+		owner = fc.session
+	}
+	tree.create(path, value, owner)
+	return path, nil
+}
+
+// Set changes the data of the node at path, as Conn.Set does.
+func (fc *FakeConn) Set(path, value string, version int) (stat *Stat, err error) {
+	tree := fc.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	node, err := fc.node("set", path)
+	if err != nil {
+		return nil, err
+	}
+	if version != -1 && int32(version) != node.stat.version {
+		return nil, &Error{Op: "set", Code: ZBADVERSION, Path: path}
+	}
+	tree.zxid++
+	node.data = value
+	node.stat.version++
+	node.stat.mzxid = tree.zxid
+	node.stat.mtime = fakeNow()
+	node.stat.dataLength = int32(len(value))
+	tree.fire(tree.dataWatches, path, EVENT_CHANGED)
+	return node.stat.stat(), nil
+}
+
+// Delete deletes the node at path, as Conn.Delete does.
+func (fc *FakeConn) Delete(path string, version int) (err error) {
+	tree := fc.tree
+	tree.mutex.Lock()
+	defer tree.mutex.Unlock()
+	node, err := fc.node("delete", path)
+	if err != nil {
+		return err
+	}
+	switch {
+	case path == "/":
+		return &Error{Op: "delete", Code: ZBADARGUMENTS, Path: path}
+	case version != -1 && int32(version) != node.stat.version:
+		return &Error{Op: "delete", Code: ZBADVERSION, Path: path}
+	case len(node.children) > 0:
+		return &Error{Op: "delete", Code: ZNOTEMPTY, Path: path}
+	}
+	tree.delete(path)
+	return nil
+}
+
+// node returns the node at path, after checking that fc is
+// open and that path is valid.  It must be called with
+// tree.mutex held.
+func (fc *FakeConn) node(op, path string) (*fakeNode, error) {
+	if fc.closed {
+		return nil, closingError(op, path)
+	}
+	if err := validatePath(op, path); err != nil {
+		return nil, err
+	}
+	node := fc.tree.nodes[path]
+	if node == nil {
+		return nil, &Error{Op: op, Code: ZNONODE, Path: path}
+	}
+	return node, nil
+}
+
+// create adds a node at path, whose parent must exist,
+// firing the respective watches.
+func (tree *fakeTree) create(path, value string, owner int64) {
+	tree.zxid++
+	now := fakeNow()
+	tree.nodes[path] = &fakeNode{
+		data:     value,
+		children: make(map[string]bool),
+		stat: statFields{
+			czxid:          tree.zxid,
+			mzxid:          tree.zxid,
+			pzxid:          tree.zxid,
+			ctime:          now,
+			mtime:          now,
+			ephemeralOwner: owner,
+			dataLength:     int32(len(value)),
+		},
+	}
+	parentPath := fakeParent(path)
+	parent := tree.nodes[parentPath]
+	parent.children[path[strings.LastIndex(path, "/")+1:]] = true
+	parent.stat.cversion++
+	parent.stat.pzxid = tree.zxid
+	parent.stat.numChildren++
+	tree.fire(tree.dataWatches, path, EVENT_CREATED)
+	tree.fire(tree.childWatches, parentPath, EVENT_CHILD)
+}
+
+// delete removes the node at path, which must have no
+// children, firing the respective watches.
+func (tree *fakeTree) delete(path string) {
+	tree.zxid++
+	delete(tree.nodes, path)
+	parentPath := fakeParent(path)
+	parent := tree.nodes[parentPath]
+	delete(parent.children, path[strings.LastIndex(path, "/")+1:])
+	parent.stat.cversion++
+	parent.stat.pzxid = tree.zxid
+	parent.stat.numChildren--
+	tree.fire(tree.dataWatches, path, EVENT_DELETED)
+	tree.fire(tree.childWatches, path, EVENT_DELETED)
+	tree.fire(tree.childWatches, parentPath, EVENT_CHILD)
+}
+
+// watch registers a watch on path for fc in watches.
+func (tree *fakeTree) watch(watches map[string][]fakeWatch, fc *FakeConn, path string) <-chan Event {
+	ch := make(chan Event, 1)
+	watches[path] = append(watches[path], fakeWatch{fc, ch})
+	return ch
+}
+
+// fire delivers an event of the given type to the
+// watches on path in watches, and closes them.
+func (tree *fakeTree) fire(watches map[string][]fakeWatch, path string, eventType int) {
+	for _, w := range watches[path] {
+		w.ch <- Event{Type: eventType, Path: path, State: STATE_CONNECTED}
+		close(w.ch)
+	}
+	delete(watches, path)
+}
+
+// fakeParent returns the path of the parent of the node at path.
+func fakeParent(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i == 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+func fakeNow() int64 {
+	return time.Now().UnixNano() / 1e6
+}
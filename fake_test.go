@@ -0,0 +1,146 @@
+package zookeeper_test
+
+import (
+	. "launchpad.net/gocheck"
+	zk "github.com/Shopify/gozk"
+)
+
+func (s *S) TestFakeConnNodes(c *C) {
+	conn, session := zk.NewFakeConn()
+	defer conn.Close()
+	c.Assert((<-session).State, Equals, zk.STATE_CONNECTED)
+
+	children, _, err := conn.Children("/")
+	c.Assert(err, IsNil)
+	c.Assert(children, DeepEquals, []string{"zookeeper"})
+
+	path, err := conn.Create("/test", "data", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+	c.Assert(path, Equals, "/test")
+
+	_, err = conn.Create("/test", "", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(zk.IsError(err, zk.ZNODEEXISTS), Equals, true, Commentf("%v", err))
+	_, err = conn.Create("/missing/child", "", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(zk.IsError(err, zk.ZNONODE), Equals, true, Commentf("%v", err))
+	_, err = conn.Create("relative", "", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(zk.IsError(err, zk.ZBADARGUMENTS), Equals, true, Commentf("%v", err))
+
+	data, stat, err := conn.Get("/test")
+	c.Assert(err, IsNil)
+	c.Assert(data, Equals, "data")
+	c.Assert(stat.Version(), Equals, 0)
+	c.Assert(stat.DataLength(), Equals, 4)
+
+	_, err = conn.Set("/test", "new", 5)
+	c.Assert(zk.IsError(err, zk.ZBADVERSION), Equals, true, Commentf("%v", err))
+	stat, err = conn.Set("/test", "new", 0)
+	c.Assert(err, IsNil)
+	c.Assert(stat.Version(), Equals, 1)
+	c.Assert(stat.Mzxid() > stat.Czxid(), Equals, true)
+
+	_, err = conn.Create("/test/b", "", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+	_, err = conn.Create("/test/a", "", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+	children, stat, err = conn.Children("/test")
+	c.Assert(err, IsNil)
+	c.Assert(children, DeepEquals, []string{"a", "b"})
+	c.Assert(stat.NumChildren(), Equals, 2)
+	c.Assert(stat.CVersion(), Equals, 2)
+
+	err = conn.Delete("/test", -1)
+	c.Assert(zk.IsError(err, zk.ZNOTEMPTY), Equals, true, Commentf("%v", err))
+	c.Assert(conn.Delete("/test/a", -1), IsNil)
+	c.Assert(conn.Delete("/test/b", -1), IsNil)
+	c.Assert(conn.Delete("/test", -1), IsNil)
+
+	stat, err = conn.Exists("/test")
+	c.Assert(err, IsNil)
+	c.Assert(stat, IsNil)
+}
+
+func (s *S) TestFakeConnSequence(c *C) {
+	conn, _ := zk.NewFakeConn()
+	defer conn.Close()
+
+	_, err := conn.Create("/queue", "", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+	for i, expected := range []string{"/queue/item-0000000000", "/queue/item-0000000001"} {
+		path, err := conn.Create("/queue/item-", "", zk.SEQUENCE, zk.WorldACL(zk.PERM_ALL))
+		c.Assert(err, IsNil, Commentf("item %d", i))
+		c.Assert(path, Equals, expected)
+	}
+}
+
+func (s *S) TestFakeConnEphemerals(c *C) {
+	conn, _ := zk.NewFakeConn()
+	other, _ := conn.NewSession()
+	defer other.Close()
+
+	_, err := conn.Create("/test", "", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+	_, err = conn.Create("/test/child", "", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(zk.IsError(err, zk.ZNOCHILDRENFOREPHEMERALS), Equals, true, Commentf("%v", err))
+
+	stat, watch, err := other.ExistsW("/test")
+	c.Assert(err, IsNil)
+	c.Assert(stat.EphemeralOwner(), Equals, conn.SessionId())
+
+	c.Assert(conn.Close(), IsNil)
+	c.Assert(<-watch, Equals, zk.Event{Type: zk.EVENT_DELETED, Path: "/test", State: zk.STATE_CONNECTED})
+
+	stat, err = other.Exists("/test")
+	c.Assert(err, IsNil)
+	c.Assert(stat, IsNil)
+
+	_, _, err = conn.Get("/")
+	c.Assert(zk.IsError(err, zk.ZCLOSING), Equals, true, Commentf("%v", err))
+	c.Assert(zk.IsError(conn.Close(), zk.ZCLOSING), Equals, true)
+}
+
+func (s *S) TestFakeConnWatches(c *C) {
+	conn, session := zk.NewFakeConn()
+	c.Assert((<-session).State, Equals, zk.STATE_CONNECTED)
+
+	stat, existsWatch, err := conn.ExistsW("/test")
+	c.Assert(err, IsNil)
+	c.Assert(stat, IsNil)
+	_, _, rootWatch, err := conn.ChildrenW("/")
+	c.Assert(err, IsNil)
+
+	_, err = conn.Create("/test", "", 0, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+
+	c.Assert(<-existsWatch, Equals, zk.Event{Type: zk.EVENT_CREATED, Path: "/test", State: zk.STATE_CONNECTED})
+	c.Assert(<-rootWatch, Equals, zk.Event{Type: zk.EVENT_CHILD, Path: "/", State: zk.STATE_CONNECTED})
+
+	// Watches fire once.
+	_, ok := <-existsWatch
+	c.Assert(ok, Equals, false)
+
+	_, _, dataWatch, err := conn.GetW("/test")
+	c.Assert(err, IsNil)
+	_, err = conn.Set("/test", "new", -1)
+	c.Assert(err, IsNil)
+	c.Assert(<-dataWatch, Equals, zk.Event{Type: zk.EVENT_CHANGED, Path: "/test", State: zk.STATE_CONNECTED})
+
+	_, _, dataWatch, err = conn.GetW("/test")
+	c.Assert(err, IsNil)
+	_, _, childWatch, err := conn.ChildrenW("/test")
+	c.Assert(err, IsNil)
+	c.Assert(conn.Delete("/test", -1), IsNil)
+	c.Assert(<-dataWatch, Equals, zk.Event{Type: zk.EVENT_DELETED, Path: "/test", State: zk.STATE_CONNECTED})
+	c.Assert(<-childWatch, Equals, zk.Event{Type: zk.EVENT_DELETED, Path: "/test", State: zk.STATE_CONNECTED})
+
+	// Watches left pending are closed along with the session.
+	_, pending, err := conn.ExistsW("/test")
+	c.Assert(err, IsNil)
+	c.Assert(conn.Close(), IsNil)
+	closed := zk.Event{Type: zk.EVENT_CLOSED, State: zk.STATE_CLOSED, CloseReason: zk.CLOSE_CONNECTION}
+	c.Assert(<-pending, Equals, closed)
+	_, ok = <-pending
+	c.Assert(ok, Equals, false)
+	c.Assert(<-session, Equals, closed)
+	_, ok = <-session
+	c.Assert(ok, Equals, false)
+}
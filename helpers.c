@@ -2,13 +2,50 @@
 #include <zookeeper.h>
 #include <pthread.h>
 #include <string.h>
+#include <time.h>
 #include "helpers.h"
 
+// watch_timing is set when the time at which watches are
+// queued must be recorded in their watch_data.
+static volatile int watch_timing = 0;
 
-static pthread_mutex_t watch_mutex = PTHREAD_MUTEX_INITIALIZER;
-static pthread_cond_t  watch_available = PTHREAD_COND_INITIALIZER;
+void set_watch_timing(int enabled) {
+    watch_timing = enabled;
+}
+
+long long monotonic_ns() {
+    struct timespec ts;
+    clock_gettime(CLOCK_MONOTONIC, &ts);
+    return (long long)ts.tv_sec * 1000000000LL + ts.tv_nsec;
+}
 
-static watch_data *first_watch = NULL;
+
+watch_queue *create_watch_queue() {
+    watch_queue *queue = malloc(sizeof(watch_queue));
+    if (queue == NULL) {
+        return NULL;
+    }
+    pthread_mutex_init(&queue->mutex, NULL);
+    pthread_cond_init(&queue->available, NULL);
+    queue->first = NULL;
+    return queue;
+}
+
+void destroy_watch_queue(watch_queue *queue) {
+    pthread_cond_destroy(&queue->available);
+    pthread_mutex_destroy(&queue->mutex);
+    free(queue);
+}
+
+conn_context *create_conn_context(watch_queue *queue, unsigned long session_watch_id) {
+    conn_context *context = malloc(sizeof(conn_context));
+    if (context == NULL) {
+        return NULL;
+    }
+    context->queue = queue;
+    context->session_watch_id = session_watch_id;
+    return context;
+}
 
 completion_data* create_completion_data() {
     completion_data *data = malloc(sizeof(completion_data));
@@ -32,46 +69,74 @@ void _handle_void_completion(int rc, const void *data_) {
     pthread_mutex_unlock(&data->mutex);
 }
 
-void _watch_handler(zhandle_t *zh, int event_type, int connection_state, 
-                    const char *event_path, void *watch_context)
+static void append_watch(watch_queue *queue, watch_data *data)
 {
-    pthread_mutex_lock(&watch_mutex);
+    pthread_mutex_lock(&queue->mutex);
     {
-        watch_data *data = malloc(sizeof(watch_data)); // XXX Check data.
-        data->connection_state = connection_state;
-        data->event_type = event_type;
-        data->event_path = strdup(event_path); // XXX Check event_path.
-        data->watch_context = watch_context;
-        data->next = NULL;
-
-        if (first_watch == NULL) {
-            first_watch = data;
+        if (queue->first == NULL) {
+            queue->first = data;
         } else {
-            watch_data *last_watch = first_watch;
+            watch_data *last_watch = queue->first;
             while (last_watch->next != NULL) {
                 last_watch = last_watch->next;
             }
             last_watch->next = data;
         }
 
-        pthread_cond_signal(&watch_available);
+        pthread_cond_signal(&queue->available);
     }
-    pthread_mutex_unlock(&watch_mutex);
+    pthread_mutex_unlock(&queue->mutex);
 }
 
-watch_data *wait_for_watch() {
+void _watch_handler(zhandle_t *zh, int event_type, int connection_state, 
+                    const char *event_path, void *watch_context)
+{
+    conn_context *context = (conn_context*)zoo_get_context(zh);
+    watch_data *data = malloc(sizeof(watch_data)); // XXX Check data.
+    data->connection_state = connection_state;
+    data->event_type = event_type;
+    data->event_path = strdup(event_path); // XXX Check event_path.
+    data->watch_context = watch_context;
+    data->interrupt = 0;
+    data->enqueued_ns = watch_timing ? monotonic_ns() : 0;
+    data->next = NULL;
+
+    // The session watch is called with the handle context itself.
+    if (watch_context == (void*)context) {
+        data->watch_context = (void*)context->session_watch_id;
+    }
+    append_watch(context->queue, data);
+}
+
+// interrupt_watch queues a watch with the interrupt flag set, so that
+// the caller of wait_for_watch that receives it knows it must stop.
+// Watches queued before it are still delivered first.
+void interrupt_watch(watch_queue *queue)
+{
+    watch_data *data = malloc(sizeof(watch_data)); // XXX Check data.
+    data->connection_state = 0;
+    data->event_type = 0;
+    data->event_path = strdup("");
+    data->watch_context = NULL;
+    data->interrupt = 1;
+    data->enqueued_ns = 0;
+    data->next = NULL;
+    append_watch(queue, data);
+}
+
+watch_data *wait_for_watch(watch_queue *queue) {
     watch_data *data = NULL;
 
-    pthread_mutex_lock(&watch_mutex);
+    pthread_mutex_lock(&queue->mutex);
     {
-        while (first_watch == NULL) {
-            pthread_cond_wait(&watch_available, &watch_mutex);
+        while (queue->first == NULL) {
+            pthread_cond_wait(&queue->available, &queue->mutex);
         }
-        data = first_watch;
-        first_watch = first_watch->next;
+        data = queue->first;
+        queue->first = queue->first->next;
         data->next = NULL;  // Just in case.
     }
-    pthread_mutex_unlock(&watch_mutex);
+    pthread_mutex_unlock(&queue->mutex);
 
     return data;
 }
@@ -86,8 +151,24 @@ void destroy_watch_data(watch_data *data) {
 watcher_fn watch_handler = _watch_handler;
 void_completion_t handle_void_completion = _handle_void_completion;
 
+void _handle_string_completion(int rc, const char *value, const void *data_) {
+    _handle_void_completion(rc, data_);
+}
+
+string_completion_t handle_string_completion = _handle_string_completion;
+
+void _handle_stat_completion(int rc, const struct Stat *stat, const void *data_) {
+    completion_data *data = (completion_data*)data_;
+    if (stat != NULL) {
+        data->stat = *stat;
+    }
+    _handle_void_completion(rc, data_);
+}
+
+stat_completion_t handle_stat_completion = _handle_stat_completion;
+
 zhandle_t *zookeeper_init_int(const char *host, watcher_fn fn,
-		int recv_timeout, const clientid_t *clientid, unsigned long context, int flags) {
+		int recv_timeout, const clientid_t *clientid, conn_context *context, int flags) {
 	return zookeeper_init(host, fn, recv_timeout, clientid, (void*)context, flags);
 }
 int zoo_wget_int(zhandle_t *zh, const char *path,
@@ -104,5 +185,128 @@ int zoo_wexists_int(zhandle_t *zh, const char *path,
 		watcher_fn watcher, unsigned long watcherCtx, struct Stat *stat) {
 	return zoo_wexists(zh, path, watcher, (void*)watcherCtx, stat);
 }
+int zoo_awexists_int(zhandle_t *zh, const char *path,
+		watcher_fn watcher, unsigned long watcherCtx,
+		stat_completion_t completion, const void *data) {
+	return zoo_awexists(zh, path, watcher, (void*)watcherCtx, completion, data);
+}
+
+// The functions below are only present in newer versions of libzookeeper.
+// They're declared here, in case the header in use predates them, and
+// referenced weakly, so that they resolve to NULL at runtime rather than
+// preventing the program from linking or loading when they're missing.
+// Any wrapper around them must check the respective have_* probe first,
+// and fail with ZUNIMPLEMENTED if the function is not available.
+//
+// Functions whose parameters use enum types in the headers declaring them
+// must not be redeclared with plain ints, as that's a conflict when the
+// header does have them, so those are only declared for older headers.
+// Headers up to 3.5 define the ZOO_*_VERSION numbers, while newer ones
+// only define the ZOO_VERSION string.
+
+#if defined(ZOO_MAJOR_VERSION)
+#define ZOO_HEADER_AT_LEAST(major, minor) \
+	(ZOO_MAJOR_VERSION > (major) || \
+	 (ZOO_MAJOR_VERSION == (major) && ZOO_MINOR_VERSION >= (minor)))
+#elif defined(ZOO_VERSION)
+#define ZOO_HEADER_AT_LEAST(major, minor) 1
+#else
+#define ZOO_HEADER_AT_LEAST(major, minor) 0
+#endif
+
+int zoo_multi(zhandle_t *zh, int count, const zoo_op_t *ops,
+		zoo_op_result_t *results);
+void zoo_create_op_init(zoo_op_t *op, const char *path, const char *value,
+		int valuelen, const struct ACL_vector *acl, int flags,
+		char *path_buffer, int path_buffer_len);
+void zoo_delete_op_init(zoo_op_t *op, const char *path, int version);
+void zoo_set_op_init(zoo_op_t *op, const char *path, const char *buffer,
+		int buflen, int version, struct Stat *stat);
+void zoo_check_op_init(zoo_op_t *op, const char *path, int version);
+int zoo_create2_ttl(zhandle_t *zh, const char *path, const char *value,
+		int valuelen, const struct ACL_vector *acl, int mode, int64_t ttl,
+		char *path_buffer, int path_buffer_len, struct Stat *stat);
+int zoo_getconfig(zhandle_t *zh, int watch, char *buffer, int* buffer_len,
+		struct Stat *stat);
+#if !ZOO_HEADER_AT_LEAST(3, 5)
+int zoo_remove_watchers(zhandle_t *zh, const char *path, int wtype,
+		watcher_fn watcher, void *watcherCtx, int local);
+#endif
+#if !ZOO_HEADER_AT_LEAST(3, 6)
+int zoo_add_watch(zhandle_t *zh, const char *path, int mode,
+		watcher_fn watcher, void *watcherCtx);
+#endif
+
+#pragma weak zoo_multi
+#pragma weak zoo_create_op_init
+#pragma weak zoo_delete_op_init
+#pragma weak zoo_set_op_init
+#pragma weak zoo_check_op_init
+#pragma weak zoo_create2_ttl
+#pragma weak zoo_getconfig
+#pragma weak zoo_remove_watchers
+#pragma weak zoo_add_watch
+
+int have_zoo_multi() {
+	return zoo_multi != NULL;
+}
+int have_zoo_create2_ttl() {
+	return zoo_create2_ttl != NULL;
+}
+int have_zoo_getconfig() {
+	return zoo_getconfig != NULL;
+}
+int have_zoo_remove_watchers() {
+	return zoo_remove_watchers != NULL;
+}
+int have_zoo_add_watch() {
+	return zoo_add_watch != NULL;
+}
+
+void init_create_op(zoo_op_t *op, const char *path, const char *value,
+		int valuelen, const struct ACL_vector *acl, int flags,
+		char *path_buffer, int path_buffer_len) {
+	zoo_create_op_init(op, path, value, valuelen, acl, flags, path_buffer, path_buffer_len);
+}
+void init_delete_op(zoo_op_t *op, const char *path, int version) {
+	zoo_delete_op_init(op, path, version);
+}
+void init_set_op(zoo_op_t *op, const char *path, const char *buffer,
+		int buflen, int version, struct Stat *stat) {
+	zoo_set_op_init(op, path, buffer, buflen, version, stat);
+}
+void init_check_op(zoo_op_t *op, const char *path, int version) {
+	zoo_check_op_init(op, path, version);
+}
+int zoo_multi_weak(zhandle_t *zh, int count, const zoo_op_t *ops,
+		zoo_op_result_t *results) {
+	if (!have_zoo_multi()) {
+		return ZUNIMPLEMENTED;
+	}
+	return zoo_multi(zh, count, ops, results);
+}
+int zoo_create2_ttl_weak(zhandle_t *zh, const char *path, const char *value,
+		int valuelen, const struct ACL_vector *acl, int mode, int64_t ttl,
+		char *path_buffer, int path_buffer_len, struct Stat *stat) {
+	if (!have_zoo_create2_ttl()) {
+		return ZUNIMPLEMENTED;
+	}
+	return zoo_create2_ttl(zh, path, value, valuelen, acl, mode, ttl,
+			path_buffer, path_buffer_len, stat);
+}
+int zoo_add_watch_int(zhandle_t *zh, const char *path, int mode,
+		watcher_fn watcher, unsigned long watcherCtx) {
+	if (!have_zoo_add_watch()) {
+		return ZUNIMPLEMENTED;
+	}
+	return zoo_add_watch(zh, path, mode, watcher, (void*)watcherCtx);
+}
+int zoo_remove_watchers_int(zhandle_t *zh, const char *path, int wtype,
+		watcher_fn watcher, unsigned long watcherCtx, int local) {
+	if (!have_zoo_remove_watchers()) {
+		return ZUNIMPLEMENTED;
+	}
+	return zoo_remove_watchers(zh, path, wtype, watcher, (void*)watcherCtx, local);
+}
 
 // vim:ts=4:sw=4:et
@@ -9,24 +9,54 @@ typedef struct _watch_data {
     int event_type;
     char *event_path;
     void *watch_context;
+    int interrupt;
+    // enqueued_ns holds the monotonic time at which the watch was
+    // queued, when watch timing is enabled, or zero otherwise.
+    long long enqueued_ns;
     struct _watch_data *next;
 } watch_data;
 
+typedef struct _watch_queue {
+    pthread_mutex_t mutex;
+    pthread_cond_t available;
+    watch_data *first;
+} watch_queue;
+
+// conn_context is the context given to zookeeper_init.  It lets the
+// watch handler find out the queue watches must be appended to, and
+// the watch id of the session watch.
+typedef struct _conn_context {
+    watch_queue *queue;
+    unsigned long session_watch_id;
+} conn_context;
+
 typedef struct _completion_data {
     pthread_mutex_t mutex;
     void *data;
+    // stat holds the stat given to handle_stat_completion, if any.
+    struct Stat stat;
 } completion_data;
 
 completion_data* create_completion_data();
 void destroy_completion_data(completion_data *data);
 void wait_for_completion(completion_data *data);
 
-watch_data *wait_for_watch();
+watch_queue *create_watch_queue();
+void destroy_watch_queue(watch_queue *queue);
+watch_data *wait_for_watch(watch_queue *queue);
+void interrupt_watch(watch_queue *queue);
 void destroy_watch_data(watch_data *data);
 
+void set_watch_timing(int enabled);
+long long monotonic_ns();
+
+conn_context *create_conn_context(watch_queue *queue, unsigned long session_watch_id);
+
 // Cgo doesn't like to use function addresses as variables.
 extern watcher_fn watch_handler;
 extern void_completion_t handle_void_completion;
+extern string_completion_t handle_string_completion;
+extern stat_completion_t handle_stat_completion;
 
 // The precise GC in Go 1.4+ doesn't like it when we cast arbitrary
 // integers to unsafe.Pointer to pass to the void* context parameter.
@@ -34,7 +64,7 @@ extern void_completion_t handle_void_completion;
 // doesn't try to interpret it as a pointer.
 
 zhandle_t *zookeeper_init_int(const char *host, watcher_fn fn,
-		int recv_timeout, const clientid_t *clientid, unsigned long context, int flags);
+		int recv_timeout, const clientid_t *clientid, conn_context *context, int flags);
 int zoo_wget_int(zhandle_t *zh, const char *path,
 		watcher_fn watcher, unsigned long watcherCtx,
 		char *buffer, int* buffer_len, struct Stat *stat);
@@ -43,6 +73,36 @@ int zoo_wget_children2_int(zhandle_t *zh, const char *path,
 		struct String_vector *strings, struct Stat *stat);
 int zoo_wexists_int(zhandle_t *zh, const char *path,
 		watcher_fn watcher, unsigned long watcherCtx, struct Stat *stat);
+int zoo_awexists_int(zhandle_t *zh, const char *path,
+		watcher_fn watcher, unsigned long watcherCtx,
+		stat_completion_t completion, const void *data);
+
+// Runtime probes for functions only present in newer versions of
+// libzookeeper.  Each returns non-zero if the function is available.
+int have_zoo_multi();
+int have_zoo_create2_ttl();
+int have_zoo_getconfig();
+int have_zoo_remove_watchers();
+int have_zoo_add_watch();
+
+// Wrappers around the weakly referenced functions above.  They
+// must only be called after the respective probe succeeds.
+void init_create_op(zoo_op_t *op, const char *path, const char *value,
+		int valuelen, const struct ACL_vector *acl, int flags,
+		char *path_buffer, int path_buffer_len);
+void init_delete_op(zoo_op_t *op, const char *path, int version);
+void init_set_op(zoo_op_t *op, const char *path, const char *buffer,
+		int buflen, int version, struct Stat *stat);
+void init_check_op(zoo_op_t *op, const char *path, int version);
+int zoo_multi_weak(zhandle_t *zh, int count, const zoo_op_t *ops,
+		zoo_op_result_t *results);
+int zoo_create2_ttl_weak(zhandle_t *zh, const char *path, const char *value,
+		int valuelen, const struct ACL_vector *acl, int mode, int64_t ttl,
+		char *path_buffer, int path_buffer_len, struct Stat *stat);
+int zoo_add_watch_int(zhandle_t *zh, const char *path, int mode,
+		watcher_fn watcher, unsigned long watcherCtx);
+int zoo_remove_watchers_int(zhandle_t *zh, const char *path, int wtype,
+		watcher_fn watcher, unsigned long watcherCtx, int local);
 
 #endif
 
@@ -0,0 +1,193 @@
+package zookeeper_test
+
+import (
+	. "launchpad.net/gocheck"
+	zk "github.com/Shopify/gozk"
+	"time"
+)
+
+func (s *S) TestLock(c *C) {
+	conn, _ := s.init(c)
+
+	l1 := zk.NewLock(conn, "/lock", zk.WorldACL(zk.PERM_ALL))
+	l2 := zk.NewLock(conn, "/lock", zk.WorldACL(zk.PERM_ALL))
+
+	c.Assert(l1.Lock(), IsNil)
+	c.Assert(l1.Lock(), Equals, zk.ErrLockHeld)
+
+	locked := make(chan error)
+	go func() {
+		locked <- l2.Lock()
+	}()
+	select {
+	case <-locked:
+		c.Fatalf("lock acquired while held")
+	case <-time.After(0.2e9):
+	}
+
+	c.Assert(l1.Unlock(), IsNil)
+	select {
+	case err := <-locked:
+		c.Assert(err, IsNil)
+	case <-time.After(5e9):
+		c.Fatalf("lock not acquired after release")
+	}
+
+	c.Assert(l1.Unlock(), Equals, zk.ErrLockNotHeld)
+	c.Assert(l2.Unlock(), IsNil)
+
+	children, _, err := conn.Children("/lock")
+	c.Assert(err, IsNil)
+	c.Assert(children, HasLen, 0)
+	c.Assert(conn.Delete("/lock", -1), IsNil)
+}
+
+func (s *S) TestTryLock(c *C) {
+	conn, _ := s.init(c)
+
+	l1 := zk.NewLock(conn, "/lock", zk.WorldACL(zk.PERM_ALL))
+	l2 := zk.NewLock(conn, "/lock", zk.WorldACL(zk.PERM_ALL))
+
+	acquired, err := l1.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(acquired, Equals, true)
+
+	acquired, err = l2.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(acquired, Equals, false)
+
+	// The failed attempt left no node behind.
+	children, _, err := conn.Children("/lock")
+	c.Assert(err, IsNil)
+	c.Assert(children, HasLen, 1)
+
+	c.Assert(l1.Unlock(), IsNil)
+
+	acquired, err = l2.TryLock()
+	c.Assert(err, IsNil)
+	c.Assert(acquired, Equals, true)
+	c.Assert(l2.Unlock(), IsNil)
+	c.Assert(conn.Delete("/lock", -1), IsNil)
+}
+
+func (s *S) TestLockWithLease(c *C) {
+	conn, _ := s.init(c)
+
+	holder := zk.NewLockWithLease(conn, "/lock", zk.WorldACL(zk.PERM_ALL), 0.2e9)
+	waiter := zk.NewLock(conn, "/lock", zk.WorldACL(zk.PERM_ALL))
+
+	c.Assert(holder.Expired(), IsNil)
+	c.Assert(holder.Lock(), IsNil)
+	expired := holder.Expired()
+	c.Assert(expired, NotNil)
+
+	// The holder "forgets" to unlock, so the waiter
+	// proceeds once the lease expires.
+	locked := make(chan error)
+	go func() {
+		locked <- waiter.Lock()
+	}()
+	select {
+	case err := <-locked:
+		c.Assert(err, IsNil)
+	case <-time.After(5e9):
+		c.Fatalf("lock not acquired after lease expired")
+	}
+	select {
+	case <-expired:
+	case <-time.After(5e9):
+		c.Fatalf("lease expiry not notified")
+	}
+
+	c.Assert(holder.Unlock(), IsNil)
+	c.Assert(waiter.Unlock(), IsNil)
+
+	// A lock released in time doesn't expire.
+	c.Assert(holder.Lock(), IsNil)
+	expired = holder.Expired()
+	c.Assert(holder.Unlock(), IsNil)
+	select {
+	case <-expired:
+		c.Fatalf("lease expired after unlock")
+	case <-time.After(0.4e9):
+	}
+	c.Assert(conn.Delete("/lock", -1), IsNil)
+}
+
+func (s *S) TestTransferEphemeral(c *C) {
+	oldConn, _ := s.init(c)
+	newConn, _ := s.init(c)
+
+	node, active, err := zk.CurrentOwner(oldConn, "/owner")
+	c.Assert(zk.IsError(err, zk.ZNONODE), Equals, true, Commentf("%v", err))
+
+	oldOwner, err := zk.TransferEphemeral(oldConn, "/owner", "old", zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+	node, active, err = zk.CurrentOwner(newConn, "/owner")
+	c.Assert(err, IsNil)
+	c.Assert(node, Equals, oldOwner.Node())
+	c.Assert(active, Equals, true)
+
+	// Record every owner the pointer names while the role changes hands.
+	stop := make(chan bool)
+	seen := make(chan []string)
+	go func() {
+		var owners []string
+		for {
+			select {
+			case <-stop:
+				seen <- owners
+				return
+			default:
+			}
+			data, _, err := newConn.Get("/owner")
+			if err == nil && (len(owners) == 0 || owners[len(owners)-1] != data) {
+				owners = append(owners, data)
+			}
+			time.Sleep(0.01e9)
+		}
+	}()
+
+	transferred := make(chan *zk.Owner)
+	go func() {
+		owner, err := zk.TransferEphemeral(newConn, "/owner", "new", zk.WorldACL(zk.PERM_ALL))
+		c.Check(err, IsNil)
+		transferred <- owner
+	}()
+	select {
+	case <-transferred:
+		c.Fatalf("ownership transferred while held")
+	case <-time.After(0.2e9):
+	}
+
+	// The old owner loses its session.
+	c.Assert(oldConn.ExpireSession(), IsNil)
+
+	var newOwner *zk.Owner
+	select {
+	case newOwner = <-transferred:
+	case <-time.After(10e9):
+		c.Fatalf("ownership not transferred after session loss")
+	}
+	c.Assert(newOwner, NotNil)
+	close(stop)
+	c.Assert(<-seen, DeepEquals, []string{oldOwner.Node(), newOwner.Node()})
+
+	node, active, err = zk.CurrentOwner(newConn, "/owner")
+	c.Assert(err, IsNil)
+	c.Assert(node, Equals, newOwner.Node())
+	c.Assert(active, Equals, true)
+	data, _, err := newConn.Get(newOwner.Node())
+	c.Assert(err, IsNil)
+	c.Assert(data, Equals, "new")
+
+	c.Assert(newOwner.Release(), IsNil)
+	node, active, err = zk.CurrentOwner(newConn, "/owner")
+	c.Assert(err, IsNil)
+	c.Assert(node, Equals, newOwner.Node())
+	c.Assert(active, Equals, false)
+	c.Assert(newOwner.Release(), IsNil)
+
+	// No watch was left behind on the owners that were gone.
+	c.Assert(newConn.DebugWatches(), HasLen, 0)
+}
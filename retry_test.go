@@ -1,9 +1,11 @@
 package zookeeper_test
 
 import (
+	"encoding/binary"
 	"errors"
 	. "launchpad.net/gocheck"
 	zk "github.com/Shopify/gozk"
+	"time"
 )
 
 func (s *S) TestRetryChangeCreating(c *C) {
@@ -264,3 +266,310 @@ func (s *S) TestRetryChangeFailsCreating(c *C) {
 
 	c.Assert(called, Equals, true)
 }
+
+// conflictingChangeFunc returns a ChangeFunc which always changes
+// the node concurrently, so that the change never succeeds.
+func conflictingChangeFunc(c *C, conn *zk.Conn, calls *int) zk.ChangeFunc {
+	return func(data string, stat *zk.Stat) (string, error) {
+		*calls++
+		_, err := conn.Set("/test", "conflict", -1)
+		c.Assert(err, IsNil)
+		return "new", nil
+	}
+}
+
+func (s *S) TestRetryChangeNContention(c *C) {
+	conn, _ := s.init(c)
+
+	_, err := conn.Create("/test", "old", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+
+	var calls int
+	err = conn.RetryChangeN("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), conflictingChangeFunc(c, conn, &calls), 3)
+	c.Assert(err, Equals, zk.ErrContention)
+	c.Assert(calls, Equals, 3)
+
+	err = conn.RetryChangeN("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL),
+		func(data string, stat *zk.Stat) (string, error) {
+			return "new", nil
+		}, 1)
+	c.Assert(err, IsNil)
+
+	data, _, err := conn.Get("/test")
+	c.Assert(err, IsNil)
+	c.Assert(data, Equals, "new")
+}
+
+func (s *S) TestRetryChangeTimeoutContention(c *C) {
+	conn, _ := s.init(c)
+
+	_, err := conn.Create("/test", "old", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+
+	var calls int
+	err = conn.RetryChangeTimeout("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), conflictingChangeFunc(c, conn, &calls), 0.1e9)
+	c.Check(zk.IsError(err, zk.ZOPERATIONTIMEOUT), Equals, true, Commentf("%v", err))
+	c.Assert(calls > 1, Equals, true)
+}
+
+func (s *S) TestRetryChangeBytes(c *C) {
+	conn, _ := s.init(c)
+
+	increment := func(data []byte, stat *zk.Stat) ([]byte, error) {
+		var n uint64
+		if stat == nil {
+			c.Assert(data, IsNil)
+		} else {
+			c.Assert(data, HasLen, 8)
+			n = binary.LittleEndian.Uint64(data)
+		}
+		data = make([]byte, 8)
+		binary.LittleEndian.PutUint64(data, n+1)
+		return data, nil
+	}
+
+	const workers = 5
+	const increments = 20
+	done := make(chan error)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < increments; j++ {
+				err := conn.RetryChangeBytes("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), increment)
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+	}
+	for i := 0; i < workers; i++ {
+		c.Assert(<-done, IsNil)
+	}
+
+	data, _, err := conn.Get("/test")
+	c.Assert(err, IsNil)
+	c.Assert(data, HasLen, 8)
+	c.Assert(binary.LittleEndian.Uint64([]byte(data)), Equals, uint64(workers*increments))
+}
+
+func (s *S) TestRetryChangeCodec(c *C) {
+	conn, _ := s.init(c)
+
+	type counter struct {
+		Name  string
+		Count int
+	}
+
+	var value counter
+	for i := 0; i < 3; i++ {
+		err := conn.RetryChangeCodec("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), zk.JSONCodec, &value,
+			func(stat *zk.Stat) error {
+				if stat == nil {
+					c.Assert(value, Equals, counter{})
+					value.Name = "counter"
+				}
+				value.Count++
+				return nil
+			})
+		c.Assert(err, IsNil)
+	}
+
+	var result counter
+	_, err := conn.GetJSON("/test", &result)
+	c.Assert(err, IsNil)
+	c.Assert(result, Equals, counter{"counter", 3})
+
+	_, err = conn.Set("/test", "not json", -1)
+	c.Assert(err, IsNil)
+	err = conn.RetryChangeCodec("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), zk.JSONCodec, &value,
+		func(stat *zk.Stat) error {
+			c.Fatal("changeFunc called on undecodable data")
+			return nil
+		})
+	c.Assert(err, FitsTypeOf, &zk.DecodeError{})
+}
+
+func (s *S) TestConstantBackoff(c *C) {
+	policy := zk.ConstantBackoff{Delay: 5 * time.Millisecond}
+	for attempt := 1; attempt != 5; attempt++ {
+		c.Assert(policy.NextDelay(attempt), Equals, 5*time.Millisecond)
+	}
+}
+
+func (s *S) TestExponentialBackoff(c *C) {
+	policy := zk.ExponentialBackoff{Initial: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	var delays []time.Duration
+	for attempt := 1; attempt != 6; attempt++ {
+		delays = append(delays, policy.NextDelay(attempt))
+	}
+	c.Assert(delays, DeepEquals, []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		40 * time.Millisecond,
+		50 * time.Millisecond,
+		50 * time.Millisecond,
+	})
+
+	unbounded := zk.ExponentialBackoff{Initial: time.Second}
+	c.Assert(unbounded.NextDelay(4), Equals, 8*time.Second)
+	c.Assert(unbounded.NextDelay(1000) > 0, Equals, true)
+}
+
+func (s *S) TestJitteredBackoff(c *C) {
+	policy := zk.JitteredBackoff{Policy: zk.ExponentialBackoff{Initial: 100 * time.Millisecond}}
+	for attempt := 1; attempt != 4; attempt++ {
+		base := 100 * time.Millisecond << uint(attempt-1)
+		for i := 0; i != 100; i++ {
+			delay := policy.NextDelay(attempt)
+			c.Assert(delay >= base/2 && delay <= base, Equals, true, Commentf("attempt %d: %v", attempt, delay))
+		}
+	}
+	c.Assert(zk.JitteredBackoff{Policy: zk.ConstantBackoff{}}.NextDelay(1), Equals, time.Duration(0))
+}
+
+type recordingBackoff struct {
+	delay    time.Duration
+	attempts []int
+}
+
+func (b *recordingBackoff) NextDelay(attempt int) time.Duration {
+	b.attempts = append(b.attempts, attempt)
+	return b.delay
+}
+
+func (s *S) TestRetryChangeBackoff(c *C) {
+	conn, _ := s.init(c)
+
+	_, err := conn.Create("/test", "old", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+
+	policy := &recordingBackoff{delay: 50 * time.Millisecond}
+	conn.SetBackoff(policy)
+
+	var calls int
+	start := time.Now()
+	err = conn.RetryChangeN("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), conflictingChangeFunc(c, conn, &calls), 3)
+	c.Assert(err, Equals, zk.ErrContention)
+	c.Assert(calls, Equals, 3)
+	c.Assert(policy.attempts, DeepEquals, []int{1, 2})
+	c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+
+	// Without a policy, retries happen right away.
+	conn.SetBackoff(nil)
+	policy.attempts = nil
+	calls = 0
+	err = conn.RetryChangeN("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), conflictingChangeFunc(c, conn, &calls), 3)
+	c.Assert(err, Equals, zk.ErrContention)
+	c.Assert(policy.attempts, IsNil)
+}
+
+func (s *S) TestUpsert(c *C) {
+	conn, _ := s.init(c)
+
+	stat, err := conn.Upsert("/test", "old", zk.WorldACL(zk.PERM_READ|zk.PERM_WRITE))
+	c.Assert(err, IsNil)
+	c.Assert(stat.Version(), Equals, 0)
+
+	aclv, _, err := conn.ACL("/test")
+	c.Assert(err, IsNil)
+	c.Assert(aclv, DeepEquals, zk.WorldACL(zk.PERM_READ|zk.PERM_WRITE))
+
+	stat, err = conn.Upsert("/test", "new", zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+	c.Assert(stat.Version(), Equals, 1)
+
+	data, _, err := conn.Get("/test")
+	c.Assert(err, IsNil)
+	c.Assert(data, Equals, "new")
+
+	_, err = conn.Upsert("/missing/test", "", zk.WorldACL(zk.PERM_ALL))
+	c.Assert(zk.IsError(err, zk.ZNONODE), Equals, true, Commentf("%v", err))
+}
+
+func (s *S) TestUpsertConcurrent(c *C) {
+	conn, _ := s.init(c)
+
+	values := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	done := make(chan error)
+	for _, value := range values {
+		go func(value string) {
+			_, err := conn.Upsert("/test", value, zk.WorldACL(zk.PERM_ALL))
+			done <- err
+		}(value)
+	}
+	for range values {
+		c.Assert(<-done, IsNil)
+	}
+
+	data, stat, err := conn.Get("/test")
+	c.Assert(err, IsNil)
+	c.Assert(data, Matches, "[a-h]")
+	c.Assert(stat.Version(), Equals, len(values)-1)
+}
+
+func (s *S) TestRetryChangeWithAttempts(c *C) {
+	conn, _ := s.init(c)
+
+	_, err := conn.Create("/test", "old", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL))
+	c.Assert(err, IsNil)
+
+	errTooMuch := errors.New("too much contention")
+	var attempts []int
+	err = conn.RetryChangeWith("/test", zk.EPHEMERAL, []zk.ACL{}, func(data string, stat *zk.Stat, attempt int) (string, error) {
+		attempts = append(attempts, attempt)
+		if attempt > 5 {
+			return "", errTooMuch
+		}
+		// Always conflict.
+		_, err := conn.Set("/test", "conflict", -1)
+		c.Assert(err, IsNil)
+		return "new", nil
+	})
+	c.Assert(err, Equals, errTooMuch)
+	c.Assert(attempts, DeepEquals, []int{1, 2, 3, 4, 5, 6})
+
+	data, stat, err := conn.Get("/test")
+	c.Assert(err, IsNil)
+	c.Assert(data, Equals, "conflict")
+	c.Assert(stat.Version(), Equals, 5)
+}
+
+func (s *S) TestRetryChangeACL(c *C) {
+	conn, _ := s.init(c)
+
+	computed := zk.WorldACL(zk.PERM_READ | zk.PERM_WRITE)
+	changeFunc := func(data string, stat *zk.Stat) (string, []zk.ACL, error) {
+		if stat == nil {
+			return "created", computed, nil
+		}
+		return data + " and set", zk.WorldACL(zk.PERM_READ), nil
+	}
+
+	// The node is created with the ACL returned.
+	err := conn.RetryChangeACL("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), changeFunc)
+	c.Assert(err, IsNil)
+	aclv, _, err := conn.ACL("/test")
+	c.Assert(err, IsNil)
+	c.Assert(aclv, DeepEquals, computed)
+
+	// Setting leaves the ACL alone.
+	err = conn.RetryChangeACL("/test", zk.EPHEMERAL, zk.WorldACL(zk.PERM_ALL), changeFunc)
+	c.Assert(err, IsNil)
+	data, _, err := conn.Get("/test")
+	c.Assert(err, IsNil)
+	c.Assert(data, Equals, "created and set")
+	aclv, _, err = conn.ACL("/test")
+	c.Assert(err, IsNil)
+	c.Assert(aclv, DeepEquals, computed)
+
+	// A nil ACL falls back to the one given.
+	err = conn.RetryChangeACL("/other", zk.EPHEMERAL, zk.WorldACL(zk.PERM_READ|zk.PERM_DELETE),
+		func(data string, stat *zk.Stat) (string, []zk.ACL, error) {
+			return "other", nil, nil
+		})
+	c.Assert(err, IsNil)
+	aclv, _, err = conn.ACL("/other")
+	c.Assert(err, IsNil)
+	c.Assert(aclv, DeepEquals, zk.WorldACL(zk.PERM_READ|zk.PERM_DELETE))
+}
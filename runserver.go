@@ -8,9 +8,11 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
@@ -60,8 +62,13 @@ func getProcess(pid int) (*os.Process, error) {
 	return nil, errors.New("server running but inaccessible")
 }
 
-// Start starts the ZooKeeper server.
-// It returns an error if the server is already running.
+// startTimeout bounds how long Start waits for the server to come up.
+const startTimeout = 30 * time.Second
+
+// Start starts the ZooKeeper server, and waits until it is accepting
+// connections.  It returns an error if the server is already running.
+// If the server fails to start, the returned error includes the output
+// it produced, which usually explains why.
 func (srv *Server) Start() error {
 	if err := srv.checkAvailability(); err != nil {
 		return err
@@ -107,6 +114,10 @@ func (srv *Server) Start() error {
 		return fmt.Errorf("cannot create log file: %v", err)
 	}
 	defer logf.Close()
+	logOffset, err := logf.Seek(0, os.SEEK_END)
+	if err != nil {
+		return fmt.Errorf("cannot seek log file: %v", err)
+	}
 	cmd.Stdout = logf
 	cmd.Stderr = logf
 	if err := cmd.Start(); err != nil {
@@ -115,7 +126,58 @@ func (srv *Server) Start() error {
 	if _, err := fmt.Fprint(pidf, cmd.Process.Pid); err != nil {
 		return fmt.Errorf("cannot write pid file: %v", err)
 	}
-	return nil
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+	return srv.waitStarted(cmd.Process, logOffset, exited)
+}
+
+// waitStarted waits until the server process p just started is
+// listening, which is detected either from its output starting at
+// logOffset in the log file or by connecting to it, or until it exits.
+// If the server doesn't start, p is killed if needed and pid.txt is
+// removed, so that no stray server is left behind.
+func (srv *Server) waitStarted(p *os.Process, logOffset int64, exited <-chan error) error {
+	addr, err := srv.Addr()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(startTimeout)
+	for {
+		output := srv.startOutput(logOffset)
+		if strings.Contains(output, "binding to port") {
+			return nil
+		}
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case err := <-exited:
+			// Pick up any output written right before exiting.
+			output = srv.startOutput(logOffset)
+			os.Remove(srv.path("pid.txt"))
+			return fmt.Errorf("server failed to start (%v): %s", err, output)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			p.Kill()
+			<-exited
+			os.Remove(srv.path("pid.txt"))
+			return fmt.Errorf("server did not start within %v: %s", startTimeout, output)
+		}
+	}
+}
+
+// startOutput returns the output written by the server
+// to its log file after logOffset.
+func (srv *Server) startOutput(logOffset int64) string {
+	data, err := ioutil.ReadFile(srv.path("log.txt"))
+	if err != nil || int64(len(data)) < logOffset {
+		return ""
+	}
+	return string(data[logOffset:])
 }
 
 // Stop kills the ZooKeeper server. It does nothing if it is not running.
@@ -169,3 +231,89 @@ func (srv *Server) Destroy() error {
 	}
 	return nil
 }
+
+// ensemblePollInterval is how often WaitEnsembleReady
+// queries the members of the ensemble.
+const ensemblePollInterval = 100 * time.Millisecond
+
+// WaitEnsembleReady waits until the given servers, which must be
+// members of the same ensemble, have formed a quorum: one of them
+// must report itself as the leader, and all others as followers or
+// observers.  A single server in standalone mode is ready as well.
+// Servers accept connections before a leader is elected, so Start
+// returning is no guarantee that writes will succeed.
+//
+// The servers are queried with the "srvr" four letter word.  If
+// the quorum is not formed within timeout, the returned error names
+// the servers that did not reach a stable role, and why.
+func WaitEnsembleReady(servers []*Server, timeout time.Duration) error {
+	if len(servers) == 0 {
+		return errors.New("zookeeper: no ensemble members given")
+	}
+	addrs := make([]string, len(servers))
+	for i, srv := range servers {
+		addr, err := srv.Addr()
+		if err != nil {
+			return fmt.Errorf("cannot get server address: %v", err)
+		}
+		addrs[i] = addr
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := EnsembleStatus(addrs)
+		if err == nil && ensembleReady(status.Members) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("zookeeper: ensemble not ready within %v: %v", timeout, err)
+			}
+			return fmt.Errorf("zookeeper: ensemble not ready within %v: %s", timeout, unsettledMembers(status.Members))
+		}
+		time.Sleep(ensemblePollInterval)
+	}
+}
+
+// ensembleReady returns whether members have formed a quorum
+// with exactly one leader, as required by WaitEnsembleReady.
+func ensembleReady(members []MemberStatus) bool {
+	if len(members) == 1 && members[0].Mode == "standalone" {
+		return true
+	}
+	leaders := 0
+	for _, member := range members {
+		switch member.Mode {
+		case "leader":
+			leaders++
+		case "follower", "observer":
+		default:
+			return false
+		}
+	}
+	return leaders == 1
+}
+
+// unsettledMembers describes the members that keep an ensemble
+// from being ready: those that couldn't be queried, and all but
+// the first leader when several of them claim the role.
+func unsettledMembers(members []MemberStatus) string {
+	var problems []string
+	leader := false
+	for _, member := range members {
+		switch {
+		case member.Err != nil:
+			problems = append(problems, fmt.Sprintf("%s (%v)", member.Addr, member.Err))
+		case member.Mode == "leader" && !leader:
+			leader = true
+		case member.Mode == "leader" || member.Mode == "standalone":
+			problems = append(problems, fmt.Sprintf("%s (also %s)", member.Addr, member.Mode))
+		}
+	}
+	if !leader && len(problems) == 0 {
+		return "no leader elected"
+	}
+	if !leader {
+		problems = append(problems, "no leader elected")
+	}
+	return strings.Join(problems, ", ")
+}
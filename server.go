@@ -2,20 +2,58 @@ package zookeeper
 
 import (
 	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 // Server represents a ZooKeeper server, its data and configuration files.
 type Server struct {
-	runDir string
-	zkDir  string
+	runDir  string
+	zkDir   string
+	javaBin string
+	jvmArgs []string
+}
+
+// ServerConfig holds optional settings for a ZooKeeper server created
+// with CreateServerWithConfig.  The zero value holds ZooKeeper's own
+// defaults.
+type ServerConfig struct {
+	// DisableForceSync stops the server from syncing its transaction
+	// log to disk before acknowledging writes.  This trades durability
+	// for speed, which is often worthwhile in tests.
+	DisableForceSync bool
+
+	// DisableStandalone makes a server configured with a single
+	// member run as a quorum rather than in standalone mode.
+	DisableStandalone bool
+
+	// ClientPortAddress is the address the server listens on for
+	// client connections, such as "127.0.0.1" or "::1".  If empty,
+	// the server listens on all addresses.
+	ClientPortAddress string
+
+	// JavaBin is the Java binary used to run the server.  If empty,
+	// "java" is looked up in PATH.
+	JavaBin string
+
+	// JVMArgs holds additional arguments for the Java virtual machine,
+	// such as -Xmx or -XX flags.  They follow the arguments gozk itself
+	// provides, so they may override its -D properties.
+	JVMArgs []string
+}
+
+// DefaultServerConfig returns the server configuration used by
+// CreateServer, which matches ZooKeeper's own defaults.
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{}
 }
 
 // CreateServer creates the directory runDir and sets up a ZooKeeper
@@ -28,6 +66,12 @@ type Server struct {
 //
 // CreateServer does not start the server.
 func CreateServer(port int, runDir, zkDir string) (*Server, error) {
+	return CreateServerWithConfig(port, runDir, zkDir, DefaultServerConfig())
+}
+
+// CreateServerWithConfig works like CreateServer, but renders the
+// provided settings into the server configuration.
+func CreateServerWithConfig(port int, runDir, zkDir string, config *ServerConfig) (*Server, error) {
 	if err := os.Mkdir(runDir, 0777); err != nil {
 		if !os.IsExist(err) {
 			return nil, err
@@ -40,16 +84,19 @@ func CreateServer(port int, runDir, zkDir string) (*Server, error) {
 			return nil, fmt.Errorf("server directory %q is not empty")
 		}
 	}
-	srv := &Server{runDir: runDir, zkDir: zkDir}
+	srv := &Server{runDir: runDir, zkDir: zkDir, javaBin: config.JavaBin, jvmArgs: config.JVMArgs}
 	if err := srv.writeLog4JConfig(); err != nil {
 		return nil, err
 	}
-	if err := srv.writeZooKeeperConfig(port); err != nil {
+	if err := srv.writeZooKeeperConfig(port, config); err != nil {
 		return nil, err
 	}
 	if err := srv.writeZkDir(); err != nil {
 		return nil, err
 	}
+	if err := srv.writeJVMConfig(); err != nil {
+		return nil, err
+	}
 	return srv, nil
 }
 
@@ -61,15 +108,21 @@ func AttachServer(runDir string) (*Server, error) {
 	if err := srv.readZkDir(); err != nil {
 		return nil, fmt.Errorf("cannot read server install directory: %v", err)
 	}
+	if err := srv.readJVMConfig(); err != nil {
+		return nil, fmt.Errorf("cannot read server JVM configuration: %v", err)
+	}
 	return srv, nil
 }
 
 func (srv *Server) checkAvailability() error {
-	port, err := srv.networkPort()
+	host, port, err := srv.clientAddress()
 	if err != nil {
 		return fmt.Errorf("cannot get network port: %v", err)
 	}
-	l, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if host == "" {
+		host = "localhost"
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
 	if err != nil {
 		return fmt.Errorf("cannot listen on port %v: %v", port, err)
 	}
@@ -77,35 +130,51 @@ func (srv *Server) checkAvailability() error {
 	return nil
 }
 
-// networkPort returns the TCP port number that
-// the server is configured for.
-func (srv *Server) networkPort() (int, error) {
-	f, err := os.Open(srv.path("zoo.cfg"))
+// clientAddress returns the address and the TCP port number that
+// the server is configured to listen on for clients.  The address
+// is empty if the server listens on all of them.
+func (srv *Server) clientAddress() (host string, port int, err error) {
+	data, err := ioutil.ReadFile(srv.path("zoo.cfg"))
 	if err != nil {
-		return 0, err
+		return "", 0, err
 	}
-	r := bufio.NewReader(f)
-	for {
-		line, err := r.ReadSlice('\n')
-		if err != nil {
-			return 0, fmt.Errorf("cannot get port from %q", srv.path("zoo.cfg"))
+	port = -1
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
 		}
-		var port int
-		if n, _ := fmt.Sscanf(string(line), "clientPort=%d\n", &port); n == 1 {
-			return port, nil
+		switch kv[0] {
+		case "clientPort":
+			if port, err = strconv.Atoi(kv[1]); err != nil {
+				return "", 0, fmt.Errorf("bad port in %q: %q", srv.path("zoo.cfg"), kv[1])
+			}
+		case "clientPortAddress":
+			// Brackets are accepted around IPv6 addresses,
+			// but not needed.
+			host = strings.TrimSuffix(strings.TrimPrefix(kv[1], "["), "]")
 		}
 	}
-	panic("not reached")
+	if port < 0 {
+		return "", 0, fmt.Errorf("cannot get port from %q", srv.path("zoo.cfg"))
+	}
+	return host, port, nil
 }
 
 // Addr returns a local host address that can be used
-// to contact the server when it is running.
+// to contact the server when it is running.  IPv6 addresses
+// are enclosed in brackets, as in "[::1]:2181".
 func (srv *Server) Addr() (string, error) {
-	port, err := srv.networkPort()
+	host, port, err := srv.clientAddress()
 	if err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("127.0.0.1:%d", port), nil
+	if host == "" || host == "0.0.0.0" {
+		host = "127.0.0.1"
+	} else if host == "::" {
+		host = "::1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
 }
 
 // command returns the command used to start the
@@ -115,14 +184,21 @@ func (srv *Server) command() ([]string, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot get class path: %v", err)
 	}
-	return []string{
-		"java",
+	javaBin := srv.javaBin
+	if javaBin == "" {
+		javaBin = "java"
+	}
+	args := []string{
+		javaBin,
 		"-cp", strings.Join(cp, ":"),
 		"-Dzookeeper.root.logger=INFO,CONSOLE",
 		"-Dlog4j.configuration=file:" + srv.path("log4j.properties"),
+	}
+	args = append(args, srv.jvmArgs...)
+	return append(args,
 		"org.apache.zookeeper.server.quorum.QuorumPeerMain",
 		srv.path("zoo.cfg"),
-	}, nil
+	), nil
 }
 
 var log4jProperties = `
@@ -137,19 +213,55 @@ func (srv *Server) writeLog4JConfig() (err error) {
 	return ioutil.WriteFile(srv.path("log4j.properties"), []byte(log4jProperties), 0666)
 }
 
-func (srv *Server) writeZooKeeperConfig(port int) (err error) {
-	return ioutil.WriteFile(srv.path("zoo.cfg"), []byte(fmt.Sprintf(
+func (srv *Server) writeZooKeeperConfig(port int, config *ServerConfig) (err error) {
+	forceSync := "yes"
+	if config.DisableForceSync {
+		forceSync = "no"
+	}
+	cfg := fmt.Sprintf(
 		"tickTime=2000\n"+
 			"dataDir=%s\n"+
 			"clientPort=%d\n"+
-			"maxClientCnxns=500\n",
-		srv.runDir, port)), 0666)
+			"maxClientCnxns=500\n"+
+			"forceSync=%s\n"+
+			"standaloneEnabled=%t\n",
+		srv.runDir, port, forceSync, !config.DisableStandalone)
+	if config.ClientPortAddress != "" {
+		// ZooKeeper wants IPv6 addresses without brackets here.
+		host := strings.TrimSuffix(strings.TrimPrefix(config.ClientPortAddress, "["), "]")
+		cfg += fmt.Sprintf("clientPortAddress=%s\n", host)
+	}
+	return ioutil.WriteFile(srv.path("zoo.cfg"), []byte(cfg), 0666)
 }
 
 func (srv *Server) writeZkDir() error {
 	return ioutil.WriteFile(srv.path("zkdir.txt"), []byte(srv.zkDir), 0666)
 }
 
+// writeJVMConfig stores the Java binary and the JVM arguments, one per
+// line, so that they're used by servers attached to the directory too.
+func (srv *Server) writeJVMConfig() error {
+	lines := append([]string{srv.javaBin}, srv.jvmArgs...)
+	return ioutil.WriteFile(srv.path("jvm.txt"), []byte(strings.Join(lines, "\n")+"\n"), 0666)
+}
+
+func (srv *Server) readJVMConfig() error {
+	data, err := ioutil.ReadFile(srv.path("jvm.txt"))
+	if os.IsNotExist(err) {
+		// Created before the JVM could be configured.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	srv.javaBin, srv.jvmArgs = lines[0], lines[1:]
+	if len(srv.jvmArgs) == 0 {
+		srv.jvmArgs = nil
+	}
+	return nil
+}
+
 func (srv *Server) readZkDir() error {
 	data, err := ioutil.ReadFile(srv.path("zkdir.txt"))
 	if err != nil {
@@ -159,11 +271,92 @@ func (srv *Server) readZkDir() error {
 	return nil
 }
 
+// installDirs holds the well known locations searched for a ZooKeeper
+// installation when no zkDir is given and the system environment file
+// is missing.
+var installDirs = []string{
+	"/usr/share/zookeeper",
+	"/usr/local/zookeeper",
+	"/opt/zookeeper",
+	"/usr/local/opt/zookeeper/libexec",
+	"/opt/homebrew/opt/zookeeper/libexec",
+	"/snap/zookeeper/current",
+}
+
+// InstallDir returns the location of the ZooKeeper installation used
+// to run the server.  That's the zkDir given to CreateServer if it was
+// not empty.  Otherwise, if the system environment file exists (see
+// SetSystemEnvironmentPath), the server runs from the class path it
+// defines, which has no installation directory, and an error is
+// returned.  Failing that, it's the first directory holding the
+// ZooKeeper libraries among the one named by the ZOOKEEPER_HOME
+// environment variable, the one holding the zkServer.sh script found
+// in PATH, and a few well known install locations.  If none is found,
+// the returned error lists all locations searched.
+func (srv *Server) InstallDir() (string, error) {
+	dir, system, err := srv.installDir()
+	if err != nil {
+		return "", err
+	}
+	if system {
+		return "", fmt.Errorf("server runs from the system installation described by %q, which has no installation directory", dir)
+	}
+	return dir, nil
+}
+
+// installDir works like InstallDir, but also returns whether
+// the location is the system environment file.
+func (srv *Server) installDir() (dir string, system bool, err error) {
+	if srv.zkDir != "" {
+		return srv.zkDir, false, nil
+	}
+	if _, err := os.Stat(zookeeperEnviron); err == nil {
+		return zookeeperEnviron, true, nil
+	}
+	var candidates []string
+	if home := os.Getenv("ZOOKEEPER_HOME"); home != "" {
+		candidates = append(candidates, home)
+	}
+	for _, script := range []string{"zkServer.sh", "zkServer"} {
+		path, err := exec.LookPath(script)
+		if err != nil {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			path = resolved
+		}
+		// The script lives in the bin directory of the installation,
+		// or of a package which keeps the installation in libexec.
+		parent := filepath.Dir(filepath.Dir(path))
+		candidates = append(candidates, parent, filepath.Join(parent, "libexec"))
+	}
+	candidates = append(candidates, installDirs...)
+
+	searched := []string{fmt.Sprintf("%s (not found)", zookeeperEnviron)}
+	for _, dir := range candidates {
+		if _, err := dirClassPath(dir); err != nil {
+			searched = append(searched, fmt.Sprintf("%s (%v)", dir, err))
+			continue
+		}
+		return dir, false, nil
+	}
+	return "", false, fmt.Errorf("cannot find ZooKeeper installation; searched: %s", strings.Join(searched, ", "))
+}
+
 func (srv *Server) classPath() ([]string, error) {
-	dir := srv.zkDir
-	if dir == "" {
+	dir, system, err := srv.installDir()
+	if err != nil {
+		return nil, err
+	}
+	if system {
 		return systemClassPath()
 	}
+	return dirClassPath(dir)
+}
+
+// dirClassPath returns the class path for running the
+// ZooKeeper installation in dir.
+func dirClassPath(dir string) ([]string, error) {
 	if err := checkDirectory(dir); err != nil {
 		return nil, err
 	}
@@ -189,48 +382,126 @@ func (srv *Server) classPath() ([]string, error) {
 	return classPath, nil
 }
 
-const zookeeperEnviron = "/etc/zookeeper/conf/environment"
+// DefaultSystemEnvironmentPath is the location of the environment file
+// of the system ZooKeeper installation on Debian and Ubuntu systems.
+const DefaultSystemEnvironmentPath = "/etc/zookeeper/conf/environment"
+
+var zookeeperEnviron = DefaultSystemEnvironmentPath
+
+// SetSystemEnvironmentPath sets the location of the environment file
+// of the system ZooKeeper installation, which defines the CLASSPATH
+// used to run servers created with an empty zkDir.  This allows the
+// system installation to be used on systems laid out differently than
+// Debian and Ubuntu.  An empty path restores the default.
+func SetSystemEnvironmentPath(path string) {
+	if path == "" {
+		path = DefaultSystemEnvironmentPath
+	}
+	zookeeperEnviron = path
+}
 
 func systemClassPath() ([]string, error) {
 	f, err := os.Open(zookeeperEnviron)
-	if f == nil {
+	if err != nil {
 		return nil, err
 	}
-	r := bufio.NewReader(f)
-	for {
-		line, err := r.ReadSlice('\n')
-		if err != nil {
-			break
-		}
-		if !bytes.HasPrefix(line, []byte("CLASSPATH=")) {
+	defer f.Close()
+	vars, err := parseEnvironment(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %q: %v", zookeeperEnviron, err)
+	}
+	path, ok := vars["CLASSPATH"]
+	if !ok {
+		return nil, fmt.Errorf("no class path found in %q", zookeeperEnviron)
+	}
+	var classPath []string
+	for _, entry := range strings.Split(path, ":") {
+		// The configuration directory is left out, since
+		// the server uses a configuration of its own.
+		if entry == "" || entry == vars["ZOOCFGDIR"] {
 			continue
 		}
+		classPath = append(classPath, entry)
+	}
+	if len(classPath) == 0 {
+		return nil, fmt.Errorf("empty class path in %q", zookeeperEnviron)
+	}
+	return classPath, nil
+}
 
-		// remove variable and newline
-		path := string(line[len("CLASSPATH=") : len(line)-1])
-
-		// trim white space
-		path = strings.Trim(path, " \t\r")
-
-		// strip quotes
-		if path[0] == '"' {
-			path = path[1 : len(path)-1]
+// parseEnvironment parses the variable assignments in a shell
+// environment file, such as the one installed with ZooKeeper, and
+// returns the resulting variables.  References to variables assigned
+// earlier in the file are expanded, and quoting is respected.  Lines
+// other than assignments are ignored.
+func parseEnvironment(r io.Reader) (map[string]string, error) {
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
 		}
+		line = strings.TrimPrefix(line, "export ")
+		i := strings.Index(line, "=")
+		if i <= 0 || strings.ContainsAny(line[:i], " \t") {
+			continue
+		}
+		vars[line[:i]] = expandShellValue(line[i+1:], vars)
+	}
+	return vars, scanner.Err()
+}
 
-		// split on :
-		classPath := strings.Split(path, ":")
-
-		// split off $ZOOCFGDIR
-		if len(classPath) > 0 && classPath[0] == "$ZOOCFGDIR" {
-			classPath = classPath[1:]
+// expandShellValue returns the value of a shell word, with quotes
+// removed and references to vars expanded.  Anything following the
+// first unquoted blank is ignored.
+func expandShellValue(word string, vars map[string]string) string {
+	var value []byte
+	var quote byte
+	for i := 0; i < len(word); i++ {
+		ch := word[i]
+		switch {
+		case quote == 0 && (ch == ' ' || ch == '\t'):
+			return string(value)
+		case ch == '\'' && quote != '"', ch == '"' && quote != '\'':
+			if quote == 0 {
+				quote = ch
+			} else {
+				quote = 0
+			}
+		case ch == '\\' && quote != '\'' && i+1 < len(word):
+			i++
+			value = append(value, word[i])
+		case ch == '$' && quote != '\'':
+			name, n := shellVarName(word[i+1:])
+			if n == 0 {
+				value = append(value, ch)
+				continue
+			}
+			value = append(value, vars[name]...)
+			i += n
+		default:
+			value = append(value, ch)
 		}
+	}
+	return string(value)
+}
 
-		if len(classPath) == 0 {
-			return nil, fmt.Errorf("empty class path in %q", zookeeperEnviron)
+// shellVarName returns the name of the variable referenced at the
+// start of s, in either the $NAME or the ${NAME} form, and the
+// number of bytes of s the reference takes.
+func shellVarName(s string) (name string, n int) {
+	if strings.HasPrefix(s, "{") {
+		end := strings.Index(s, "}")
+		if end < 0 {
+			return "", 0
 		}
-		return classPath, nil
+		return s[1:end], end + 1
+	}
+	for n < len(s) && (s[n] == '_' || 'a' <= s[n] && s[n] <= 'z' || 'A' <= s[n] && s[n] <= 'Z' || n > 0 && '0' <= s[n] && s[n] <= '9') {
+		n++
 	}
-	return nil, fmt.Errorf("no class path found in %q", zookeeperEnviron)
+	return s[:n], n
 }
 
 // checkDirectory returns an error if the given path
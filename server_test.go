@@ -2,8 +2,10 @@ package zookeeper_test
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	. "launchpad.net/gocheck"
 	zk "github.com/Shopify/gozk"
 	"os"
@@ -244,3 +246,296 @@ func (s *S) TestCreateServer(c *C) {
 	err = srv.Destroy()
 	c.Assert(err, IsNil)
 }
+
+func (s *S) TestCreateServerWithConfig(c *C) {
+	dir := c.MkDir()
+
+	srv, err := zk.CreateServer(9999, dir+"/default", "")
+	c.Assert(err, IsNil)
+	data, err := ioutil.ReadFile(dir + "/default/zoo.cfg")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, "(?s).*\nforceSync=yes\n.*")
+	c.Assert(string(data), Matches, "(?s).*\nstandaloneEnabled=true\n.*")
+	c.Assert(srv.Destroy(), IsNil)
+
+	// The zero value holds the defaults too.
+	srv, err = zk.CreateServerWithConfig(9999, dir+"/zero", "", &zk.ServerConfig{JavaBin: "java"})
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(dir + "/zero/zoo.cfg")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, "(?s).*\nforceSync=yes\n.*")
+	c.Assert(string(data), Matches, "(?s).*\nstandaloneEnabled=true\n.*")
+	c.Assert(srv.Destroy(), IsNil)
+
+	config := zk.DefaultServerConfig()
+	config.DisableForceSync = true
+	config.DisableStandalone = true
+	srv, err = zk.CreateServerWithConfig(9999, dir+"/custom", "", config)
+	c.Assert(err, IsNil)
+	data, err = ioutil.ReadFile(dir + "/custom/zoo.cfg")
+	c.Assert(err, IsNil)
+	c.Assert(string(data), Matches, "(?s).*\nforceSync=no\n.*")
+	c.Assert(string(data), Matches, "(?s).*\nstandaloneEnabled=false\n.*")
+	c.Assert(srv.Destroy(), IsNil)
+}
+
+func (s *S) TestServerClientPortAddress(c *C) {
+	dir := c.MkDir()
+
+	for i, host := range []string{"::1", "[::1]"} {
+		config := zk.DefaultServerConfig()
+		config.ClientPortAddress = host
+		runDir := fmt.Sprintf("%s/%d", dir, i)
+		srv, err := zk.CreateServerWithConfig(9999, runDir, "", config)
+		c.Assert(err, IsNil)
+		data, err := ioutil.ReadFile(runDir + "/zoo.cfg")
+		c.Assert(err, IsNil)
+		c.Assert(string(data), Matches, "(?s).*\nclientPortAddress=::1\n.*")
+
+		addr, err := srv.Addr()
+		c.Assert(err, IsNil)
+		c.Assert(addr, Equals, "[::1]:9999")
+
+		// Attached servers read the address back from zoo.cfg.
+		srv, err = zk.AttachServer(runDir)
+		c.Assert(err, IsNil)
+		addr, err = srv.Addr()
+		c.Assert(err, IsNil)
+		c.Assert(addr, Equals, "[::1]:9999")
+		c.Assert(srv.Destroy(), IsNil)
+	}
+}
+
+func (s *S) TestServerJVMConfig(c *C) {
+	dir := c.MkDir()
+	zkDir := dir + "/zk"
+	c.Assert(os.MkdirAll(zkDir+"/lib", 0777), IsNil)
+	c.Assert(ioutil.WriteFile(zkDir+"/lib/zookeeper.jar", nil, 0666), IsNil)
+
+	srv, err := zk.CreateServer(9999, dir+"/default", zkDir)
+	c.Assert(err, IsNil)
+	args, err := zk.ServerCommand(srv)
+	c.Assert(err, IsNil)
+	c.Assert(args, DeepEquals, []string{
+		"java",
+		"-cp", zkDir + "/lib/zookeeper.jar",
+		"-Dzookeeper.root.logger=INFO,CONSOLE",
+		"-Dlog4j.configuration=file:" + dir + "/default/log4j.properties",
+		"org.apache.zookeeper.server.quorum.QuorumPeerMain",
+		dir + "/default/zoo.cfg",
+	})
+
+	config := zk.DefaultServerConfig()
+	config.JavaBin = "/opt/jdk/bin/java"
+	config.JVMArgs = []string{"-Xmx64m", "-XX:+HeapDumpOnOutOfMemoryError"}
+	srv, err = zk.CreateServerWithConfig(9999, dir+"/custom", zkDir, config)
+	c.Assert(err, IsNil)
+	expected := []string{
+		"/opt/jdk/bin/java",
+		"-cp", zkDir + "/lib/zookeeper.jar",
+		"-Dzookeeper.root.logger=INFO,CONSOLE",
+		"-Dlog4j.configuration=file:" + dir + "/custom/log4j.properties",
+		"-Xmx64m",
+		"-XX:+HeapDumpOnOutOfMemoryError",
+		"org.apache.zookeeper.server.quorum.QuorumPeerMain",
+		dir + "/custom/zoo.cfg",
+	}
+	args, err = zk.ServerCommand(srv)
+	c.Assert(err, IsNil)
+	c.Assert(args, DeepEquals, expected)
+
+	// The configuration survives attaching to the server.
+	srv, err = zk.AttachServer(dir + "/custom")
+	c.Assert(err, IsNil)
+	args, err = zk.ServerCommand(srv)
+	c.Assert(err, IsNil)
+	c.Assert(args, DeepEquals, expected)
+}
+
+func (s *S) TestSystemEnvironmentPath(c *C) {
+	path := c.MkDir() + "/environment"
+	err := ioutil.WriteFile(path, []byte("NAME=zookeeper\nCLASSPATH=\"$ZOOCFGDIR:/usr/share/java/zookeeper.jar:/usr/share/java/log4j.jar\"\n"), 0666)
+	c.Assert(err, IsNil)
+
+	zk.SetSystemEnvironmentPath(path)
+	defer zk.SetSystemEnvironmentPath("")
+
+	classPath, err := zk.SystemClassPath()
+	c.Assert(err, IsNil)
+	c.Assert(classPath, DeepEquals, []string{"/usr/share/java/zookeeper.jar", "/usr/share/java/log4j.jar"})
+
+	zk.SetSystemEnvironmentPath(path + ".missing")
+	_, err = zk.SystemClassPath()
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *S) TestServerInstallDir(c *C) {
+	dir := c.MkDir()
+	home := dir + "/home"
+	c.Assert(os.MkdirAll(home+"/lib", 0777), IsNil)
+	c.Assert(ioutil.WriteFile(home+"/lib/zookeeper.jar", nil, 0666), IsNil)
+
+	zk.SetSystemEnvironmentPath(dir + "/environment.missing")
+	defer zk.SetSystemEnvironmentPath("")
+	defer os.Setenv("ZOOKEEPER_HOME", os.Getenv("ZOOKEEPER_HOME"))
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+	defer func(dirs []string) { *zk.InstallDirs = dirs }(*zk.InstallDirs)
+	*zk.InstallDirs = []string{dir + "/missing"}
+
+	// The explicit zkDir wins.
+	srv, err := zk.CreateServer(9999, dir+"/explicit", home)
+	c.Assert(err, IsNil)
+	installDir, err := srv.InstallDir()
+	c.Assert(err, IsNil)
+	c.Assert(installDir, Equals, home)
+
+	srv, err = zk.CreateServer(9999, dir+"/found", "")
+	c.Assert(err, IsNil)
+
+	os.Setenv("ZOOKEEPER_HOME", home)
+	installDir, err = srv.InstallDir()
+	c.Assert(err, IsNil)
+	c.Assert(installDir, Equals, home)
+
+	os.Setenv("ZOOKEEPER_HOME", "")
+	_, err = srv.InstallDir()
+	c.Assert(err, ErrorMatches, "cannot find ZooKeeper installation; searched: .*/environment.missing \\(not found\\), .*/missing \\(.*\\)")
+
+	// The system installation has no directory of its own.
+	environ := dir + "/environment"
+	c.Assert(ioutil.WriteFile(environ, []byte("CLASSPATH=/usr/share/java/zookeeper.jar\n"), 0666), IsNil)
+	zk.SetSystemEnvironmentPath(environ)
+	_, err = srv.InstallDir()
+	c.Assert(err, ErrorMatches, `server runs from the system installation described by ".*/environment", which has no installation directory`)
+}
+
+var systemClassPathTests = []struct {
+	environ   string
+	classPath []string
+	err       string
+}{{
+	// Debian and Ubuntu.
+	environ: `NAME=zookeeper
+ZOOCFGDIR=/etc/$NAME/conf
+
+# TODO this is really ugly
+# How to find out, which jars are needed?
+# seems, that log4j requires the log4j.properties file to be in the classpath
+CLASSPATH="$ZOOCFGDIR:/usr/share/java/jline.jar:/usr/share/java/log4j-1.2.jar:/usr/share/java/xercesImpl.jar:/usr/share/java/xmlParserAPIs.jar:/usr/share/java/netty.jar:/usr/share/java/slf4j-api.jar:/usr/share/java/slf4j-log4j12.jar:/usr/share/java/zookeeper.jar"
+
+ZOOCFG="$ZOOCFGDIR/zoo.cfg"
+ZOO_LOG_DIR=/var/log/$NAME
+USER=$NAME
+GROUP=$NAME
+PIDDIR=/var/run/$NAME
+PIDFILE=$PIDDIR/$NAME.pid
+SCRIPTNAME=/etc/init.d/$NAME
+JAVA=/usr/bin/java
+ZOOMAIN="org.apache.zookeeper.server.quorum.QuorumPeerMain"
+ZOO_LOG4J_PROP="INFO,ROLLINGFILE"
+JMXLOCALONLY=false
+JAVA_OPTS=""
+`,
+	classPath: []string{
+		"/usr/share/java/jline.jar",
+		"/usr/share/java/log4j-1.2.jar",
+		"/usr/share/java/xercesImpl.jar",
+		"/usr/share/java/xmlParserAPIs.jar",
+		"/usr/share/java/netty.jar",
+		"/usr/share/java/slf4j-api.jar",
+		"/usr/share/java/slf4j-log4j12.jar",
+		"/usr/share/java/zookeeper.jar",
+	},
+}, {
+	// Exported variables, braces, and incremental assignments.
+	environ: `export ZOOKEEPER_HOME=/opt/zookeeper
+export ZOOCFGDIR=${ZOOKEEPER_HOME}/conf
+CLASSPATH=$ZOOCFGDIR
+CLASSPATH=$CLASSPATH:${ZOOKEEPER_HOME}/zookeeper.jar
+CLASSPATH=$CLASSPATH:$ZOOKEEPER_HOME/lib/slf4j-api.jar:
+`,
+	classPath: []string{
+		"/opt/zookeeper/zookeeper.jar",
+		"/opt/zookeeper/lib/slf4j-api.jar",
+	},
+}, {
+	// Entries with spaces and single quotes.
+	environ: `LIB="/Library/Application Support/zookeeper"
+CLASSPATH="$LIB/zookeeper.jar"::'/opt/literal $dir/log4j.jar' # comment
+`,
+	classPath: []string{
+		"/Library/Application Support/zookeeper/zookeeper.jar",
+		"/opt/literal $dir/log4j.jar",
+	},
+}, {
+	environ: "NAME=zookeeper\n",
+	err:     `no class path found in ".*"`,
+}, {
+	environ: "CLASSPATH=$ZOOCFGDIR::\n",
+	err:     `empty class path in ".*"`,
+}}
+
+func (s *S) TestSystemClassPathParsing(c *C) {
+	path := c.MkDir() + "/environment"
+	zk.SetSystemEnvironmentPath(path)
+	defer zk.SetSystemEnvironmentPath("")
+
+	for i, t := range systemClassPathTests {
+		c.Logf("test %d", i)
+		err := ioutil.WriteFile(path, []byte(t.environ), 0666)
+		c.Assert(err, IsNil)
+		classPath, err := zk.SystemClassPath()
+		if t.err != "" {
+			c.Check(err, ErrorMatches, t.err)
+		} else {
+			c.Check(err, IsNil)
+			c.Check(classPath, DeepEquals, t.classPath)
+		}
+	}
+}
+
+func (s *S) TestServerStartFailure(c *C) {
+	// A bogus installation directory, whose jar file holds no server.
+	zkDir := c.MkDir()
+	err := ioutil.WriteFile(zkDir+"/zookeeper-bogus.jar", nil, 0666)
+	c.Assert(err, IsNil)
+
+	runDir := c.MkDir() + "/zk"
+	srv, err := zk.CreateServer(21813, runDir, zkDir)
+	c.Assert(err, IsNil)
+	defer srv.Destroy()
+
+	err = srv.Start()
+	c.Assert(err, ErrorMatches, `(?s)server failed to start \(.*\): .*QuorumPeerMain.*`)
+
+	// No pid.txt is left naming the dead process.
+	_, err = os.Stat(runDir + "/pid.txt")
+	c.Assert(os.IsNotExist(err), Equals, true, Commentf("%v", err))
+}
+
+func (s *S) TestEnsembleReady(c *C) {
+	member := func(mode string) zk.MemberStatus {
+		return zk.MemberStatus{Mode: mode}
+	}
+	down := zk.MemberStatus{Err: errors.New("connection refused")}
+	c.Assert(zk.EnsembleReady([]zk.MemberStatus{member("standalone")}), Equals, true)
+	c.Assert(zk.EnsembleReady([]zk.MemberStatus{member("leader"), member("follower"), member("observer")}), Equals, true)
+	c.Assert(zk.EnsembleReady([]zk.MemberStatus{member("follower"), member("follower")}), Equals, false)
+	c.Assert(zk.EnsembleReady([]zk.MemberStatus{member("leader"), member("leader")}), Equals, false)
+	c.Assert(zk.EnsembleReady([]zk.MemberStatus{member("leader"), member("follower"), down}), Equals, false)
+}
+
+func (s *S) TestWaitEnsembleReady(c *C) {
+	err := zk.WaitEnsembleReady([]*zk.Server{s.zkServer}, 5*time.Second)
+	if err != nil && strings.Contains(err.Error(), zk.ErrFourLetterWordNotAllowed.Error()) {
+		c.Skip("srvr is not whitelisted on the test server")
+	}
+	c.Assert(err, IsNil)
+
+	// A server that was never started doesn't become ready.
+	srv, err := zk.CreateServer(21814, c.MkDir()+"/zk", "")
+	c.Assert(err, IsNil)
+	err = zk.WaitEnsembleReady([]*zk.Server{srv}, 200*time.Millisecond)
+	c.Assert(err, ErrorMatches, `zookeeper: ensemble not ready within 200ms: .*127\.0\.0\.1:21814.*`)
+}
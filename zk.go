@@ -19,12 +19,25 @@ import "C"
 
 import (
 	"bytes"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 )
 
@@ -32,11 +45,96 @@ import (
 // Main constants and data types.
 
 // Conn represents a connection to a set of ZooKeeper nodes.
+//
+// A Conn is safe for concurrent use by multiple goroutines.  Operations
+// hold a read lock on the connection while they use the underlying
+// handle, and Close takes the write lock, so Close waits for in-flight
+// operations to complete and operations started afterwards fail with
+// a ZCLOSING error rather than using a freed handle.
 type Conn struct {
+	id             string
 	watchChannels  map[uintptr]chan Event
+	watchCallbacks map[uintptr]func(Event)
+	authFailed     chan struct{}
 	sessionWatchId uintptr
 	handle         *C.zhandle_t
+	context        *C.conn_context
+	watchLoop      *watchLoop
 	mutex          sync.RWMutex
+	servers        string
+	defaultACL     []ACL
+	backoff        BackoffPolicy
+
+	// opTimeout is the timeout set with SetDefaultOpTimeout, and
+	// abandonedOps the number of requests that outlived it and are
+	// still blocked in the C library.  They have a mutex of their own
+	// since such requests hold conn.mutex.
+	opTimeout      time.Duration
+	abandonedOps   int
+	opTimeoutMutex sync.Mutex
+
+	// inFlight holds one value for each outstanding asynchronous
+	// operation, bounding how many may be pending at once.
+	// It is nil when the number of operations is unbounded.
+	inFlight      chan bool
+	inFlightMutex sync.Mutex
+
+	// auths holds the credentials successfully added with AddAuth.
+	auths      []authInfo
+	authsMutex sync.Mutex
+
+	// ephemerals holds the live nodes created with CreateEphemeral.
+	ephemerals      map[*EphemeralNode]bool
+	ephemeralsMutex sync.Mutex
+
+	// breaker makes operations fail fast under sustained
+	// connection loss, when enabled with SetCircuitBreaker.
+	breaker circuitBreaker
+
+	// persistentWatches holds the ids of the watches established with
+	// AddWatch, which remain registered after delivering an event.
+	// It's guarded by watchMutex.
+	persistentWatches map[uintptr]bool
+
+	// sharedWatches holds the armed watches shared by the callers of
+	// the *W methods, when enabled with SetSharedWatches.
+	shareWatches       bool
+	sharedWatches      map[sharedWatchKey]*sharedWatch
+	sharedWatchesMutex sync.Mutex
+
+	// reconnects counts the times the session was connected again
+	// after losing its connection, as observed by trackReconnects,
+	// lostAt is when the connection was last lost, and connectedAt
+	// when it was last established.
+	// These fields are guarded by watchMutex.
+	reconnects     int64
+	everConnected  bool
+	lostConnection bool
+	lostAt         time.Time
+	connectedAt    time.Time
+
+	// recentReconnects holds when the session was connected again
+	// within the last qualityWindow.  It's guarded by watchMutex.
+	recentReconnects []time.Time
+
+	// pingRTTs holds the round trip times of the latest pings, and
+	// pingStop stops the background pings set with SetPingInterval.
+	pingRTTs  []time.Duration
+	pingStop  chan struct{}
+	pingMutex sync.Mutex
+
+	// watchRecords describes the watches established by the
+	// application, for DebugWatches.  It's guarded by watchMutex.
+	watchRecords map[uintptr]watchRecord
+
+	// omitClosedEvent is set with SetInjectClosedEvent when
+	// channels must be closed without delivering an EVENT_CLOSED
+	// event first.  It's guarded by watchMutex.
+	omitClosedEvent bool
+}
+
+type authInfo struct {
+	scheme, cert string
 }
 
 // ClientId represents an established ZooKeeper session.  It can be
@@ -83,22 +181,46 @@ type ACL struct {
 // Since every watch channel may receive critical session events, events
 // received must not be handled blindly as if the watch requested has
 // been fired.  To facilitate such tests, Events offer the Ok method,
-// and they also have a good String method so they may be used as an
-// os.Error value if wanted. E.g.:
+// and they also implement the error interface, with the Err method
+// returning the event itself as an error unless it is Ok. E.g.:
 //
 //	event := <-watch
-//	if !event.Ok() {
-//	    err = event
+//	if err = event.Err(); err != nil {
 //	    return
 //	}
 //
 // Note that closed channels will deliver zeroed Event, which means
 // event.Type is set to EVENT_CLOSED and event.State is set to STATE_CLOSED,
 // to facilitate handling.
+//
+// The last event delivered on a channel before it is closed for any
+// reason other than the watch firing has its CloseReason set to one of
+// the CLOSE_* constants, so that the application may decide whether
+// re-establishing the watch makes sense.  When the connection is closed,
+// a final event with State set to STATE_CLOSED and CloseReason set to
+// CLOSE_CONNECTION is injected right before the channel is closed,
+// unless disabled with Conn.SetInjectClosedEvent.
+//
+// Events are dispatched in the same order they are received from
+// ZooKeeper, and each of them is stamped with a Seq number that is
+// strictly increasing across all connections in the process.  Comparing
+// Seq values allows detecting reordered or dropped events.  Events
+// injected by gozk itself, such as the closing event, have a zero Seq.
+//
+// Watches pending when the connection to the server is lost are closed
+// with CLOSE_SESSION_EVENT as their CloseReason, and are not carried
+// over to the reestablished connection.  The C library still registers
+// them again with the server once reconnected, but should they fire
+// their events are discarded, so a watch channel never receives more
+// than one non-closing event.  Watches that are still relevant must be
+// re-armed by the application after reconnecting, by calling the
+// respective W-suffixed function again.
 type Event struct {
-	Type  int    // One of the EVENT_* constants.
-	Path  string // For non-session events, the path of the watched node.
-	State int    // One of the STATE_* constants.
+	Type        int    // One of the EVENT_* constants.
+	Path        string // For non-session events, the path of the watched node.
+	State       int    // One of the STATE_* constants.
+	CloseReason int    // One of the CLOSE_* constants.
+	Seq         uint64 // Order in which the event was received.
 }
 
 // Error represents a ZooKeeper error.
@@ -106,8 +228,34 @@ type Error struct {
 	Op   string
 	Code ErrorCode
 	// SystemError holds an error if Code is ZSYSTEMERROR.
+	// When the error originates from the C library, it
+	// is a *SystemError holding the errno value.
 	SystemError error
 	Path        string
+	// Detail optionally holds further information about the
+	// error, when it is detected by gozk itself.
+	Detail string
+}
+
+// SystemError represents the operating system error underlying
+// a ZSYSTEMERROR reported by the C library.
+type SystemError struct {
+	errno syscall.Errno
+}
+
+func (e *SystemError) Error() string {
+	return e.errno.Error()
+}
+
+// Code returns the ZooKeeper error code, which is always ZSYSTEMERROR.
+func (e *SystemError) Code() ErrorCode {
+	return ZSYSTEMERROR
+}
+
+// Errno returns the errno value set by the C library, allowing the
+// cause to be checked against values such as syscall.ECONNREFUSED.
+func (e *SystemError) Errno() syscall.Errno {
+	return e.errno
 }
 
 func (e *Error) Error() string {
@@ -115,6 +263,9 @@ func (e *Error) Error() string {
 	if e.Code == ZSYSTEMERROR && e.SystemError != nil {
 		s = e.SystemError.Error()
 	}
+	if e.Detail != "" {
+		s += ": " + e.Detail
+	}
 	if e.Path == "" {
 		return fmt.Sprintf("zookeeper: %s: %v", e.Op, s)
 	}
@@ -178,7 +329,11 @@ func zkError(rc C.int, cerr error, op, path string) error {
 		Path: path,
 	}
 	if code == ZSYSTEMERROR {
-		err.SystemError = cerr
+		if errno, ok := cerr.(syscall.Errno); ok {
+			err.SystemError = &SystemError{errno}
+		} else {
+			err.SystemError = cerr
+		}
 	}
 	return err
 }
@@ -187,6 +342,21 @@ func closingError(op, path string) error {
 	return zkError(C.int(ZCLOSING), nil, op, path)
 }
 
+// eventError returns the error corresponding to a critical session
+// event received while waiting on a watch.
+func eventError(event Event, op, path string) error {
+	code := ZCONNECTIONLOSS
+	switch event.State {
+	case STATE_EXPIRED_SESSION:
+		code = ZSESSIONEXPIRED
+	case STATE_AUTH_FAILED:
+		code = ZAUTHFAILED
+	case STATE_CLOSED:
+		code = ZCLOSING
+	}
+	return zkError(C.int(code), nil, op, path)
+}
+
 // Constants for SetLogLevel.
 const (
 	LOG_ERROR = C.ZOO_LOG_LEVEL_ERROR
@@ -199,10 +369,83 @@ const (
 // variables here they are inlined, and correctness is ensured on
 // init().
 
-// Constants for Create's flags parameter.
+// Constants for Create's flags parameter.  EPHEMERAL and SEQUENCE may
+// be combined freely.  CONTAINER may not be combined with any other
+// flag, and TTL must be used with CreateTTL, optionally along with
+// SEQUENCE.
 const (
 	EPHEMERAL = 1 << iota
 	SEQUENCE
+	CONTAINER
+	TTL
+)
+
+// MaxTTL is the longest time to live accepted by ZooKeeper for
+// nodes created with CreateTTL.
+const MaxTTL = (1<<40 - 1) * time.Millisecond
+
+// Node creation modes understood by the C library.
+const (
+	modePersistent            = 0
+	modeContainer             = 4
+	modePersistentTTL         = 5
+	modePersistentSequenceTTL = 6
+)
+
+// createMode validates the flags given to Create or CreateTTL, along
+// with the time to live, which is zero for Create, and returns the
+// respective creation mode.  The modes allowed are:
+//
+//	flags                Create  CreateTTL
+//	0                    yes     no
+//	EPHEMERAL            yes     no
+//	SEQUENCE             yes     no
+//	EPHEMERAL|SEQUENCE   yes     no
+//	CONTAINER            yes     no
+//	TTL                  no      yes
+//	TTL|SEQUENCE         no      yes
+//
+// Any other combination is rejected, as is a time to live that isn't
+// positive or exceeds MaxTTL.
+func createMode(flags int, ttl time.Duration, op, path string) (int, error) {
+	bad := func(detail string) (int, error) {
+		return 0, &Error{Op: op, Code: ZBADARGUMENTS, Path: path, Detail: detail}
+	}
+	switch {
+	case flags&^(EPHEMERAL|SEQUENCE|CONTAINER|TTL) != 0:
+		return bad(fmt.Sprintf("unknown flags %#x", flags&^(EPHEMERAL|SEQUENCE|CONTAINER|TTL)))
+	case flags&CONTAINER != 0 && flags&TTL != 0:
+		return bad("container nodes cannot have a TTL")
+	case flags&CONTAINER != 0 && flags&EPHEMERAL != 0:
+		return bad("container nodes cannot be ephemeral")
+	case flags&CONTAINER != 0 && flags&SEQUENCE != 0:
+		return bad("container nodes cannot be sequential")
+	case flags&TTL != 0 && flags&EPHEMERAL != 0:
+		return bad("ephemeral nodes cannot have a TTL")
+	case flags&TTL != 0 && ttl == 0:
+		return bad("TTL flag requires CreateTTL")
+	case flags&TTL == 0 && ttl != 0:
+		return bad("CreateTTL requires the TTL flag")
+	case flags&TTL != 0 && ttl < time.Millisecond:
+		return bad(fmt.Sprintf("TTL %v is not positive", ttl))
+	case flags&TTL != 0 && ttl > MaxTTL:
+		return bad(fmt.Sprintf("TTL %v exceeds maximum of %v", ttl, MaxTTL))
+	}
+	switch {
+	case flags&CONTAINER != 0:
+		return modeContainer, nil
+	case flags&TTL != 0 && flags&SEQUENCE != 0:
+		return modePersistentSequenceTTL, nil
+	case flags&TTL != 0:
+		return modePersistentTTL, nil
+	}
+	// EPHEMERAL and SEQUENCE match the respective mode bits.
+	return modePersistent | flags, nil
+}
+
+// Constants for DialFlags's flags parameter.
+const (
+	READONLY = 1 << iota
 )
 
 // Constants for ACL Perms.
@@ -229,6 +472,33 @@ const (
 	EVENT_CLOSED = 0
 )
 
+// Constants for Event CloseReason.
+const (
+	// The channel is not being closed, or it is being closed
+	// because the watch fired.
+	CLOSE_NONE = iota
+
+	// The connection was closed with Close.
+	CLOSE_CONNECTION
+
+	// The session expired, and the watch will never fire.
+	CLOSE_SESSION_EXPIRED
+
+	// The watch was dropped due to a transient session event
+	// such as a connection loss, and may be re-established.
+	CLOSE_SESSION_EVENT
+
+	// Events were not collected quickly enough from a connection
+	// established with DialIsolated, and all of its channels
+	// were closed.
+	CLOSE_BUFFER_FULL
+
+	// The server stopped maintaining the watch, which was delivered
+	// an EVENT_NOTWATCHING event.  The watch will never fire, and must
+	// be re-established if still wanted.
+	CLOSE_NOT_WATCHING
+)
+
 // Constants for Event State.
 const (
 	STATE_EXPIRED_SESSION = -112
@@ -243,7 +513,8 @@ const (
 )
 
 func init() {
-	if EPHEMERAL != C.ZOO_EPHEMERAL ||
+	if READONLY != C.ZOO_READONLY ||
+		EPHEMERAL != C.ZOO_EPHEMERAL ||
 		SEQUENCE != C.ZOO_SEQUENCE ||
 		PERM_READ != C.ZOO_PERM_READ ||
 		PERM_WRITE != C.ZOO_PERM_WRITE ||
@@ -265,9 +536,79 @@ func init() {
 
 		panic("OOPS: Constants don't match C counterparts")
 	}
+	sharedWatchLoop.queue = C.create_watch_queue()
+	if sharedWatchLoop.queue == nil {
+		panic("Failed to create watch queue")
+	}
 	SetLogLevel(0)
 }
 
+var aclSchemesMutex sync.Mutex
+var aclSchemes = map[string]bool{
+	"world":  true,
+	"auth":   true,
+	"digest": true,
+	"ip":     true,
+	"x509":   true,
+}
+
+// RegisterACLScheme registers an additional ACL scheme to be accepted
+// by the client side validation of ACLs, such as the ones provided by
+// custom authentication providers in the server.  The "world", "auth",
+// "digest", "ip" and "x509" schemes are always accepted.
+func RegisterACLScheme(scheme string) {
+	aclSchemesMutex.Lock()
+	aclSchemes[scheme] = true
+	aclSchemesMutex.Unlock()
+}
+
+var aclTemplatesMutex sync.Mutex
+var aclTemplates = make(map[string][]ACL)
+
+// RegisterACL registers aclv as an ACL template under the given name,
+// replacing any previous template with the same name.  Templates allow
+// ACLs to be defined once and referred to by name, as done by CreateT.
+func RegisterACL(name string, aclv []ACL) {
+	aclTemplatesMutex.Lock()
+	aclTemplates[name] = append([]ACL(nil), aclv...)
+	aclTemplatesMutex.Unlock()
+}
+
+// lookupACL returns the ACL template registered under name, or
+// a ZINVALIDACL error if there isn't one.
+func lookupACL(name, op, path string) ([]ACL, error) {
+	aclTemplatesMutex.Lock()
+	defer aclTemplatesMutex.Unlock()
+	aclv, ok := aclTemplates[name]
+	if !ok {
+		return nil, &Error{Op: op, Code: ZINVALIDACL, Path: path, Detail: fmt.Sprintf("unknown ACL template %q", name)}
+	}
+	return aclv, nil
+}
+
+// validateACL checks aclv for obviously malformed entries before it is
+// sent to the server, returning a ZINVALIDACL error describing the
+// problem if one is found.
+func validateACL(aclv []ACL, op, path string) error {
+	aclSchemesMutex.Lock()
+	defer aclSchemesMutex.Unlock()
+	for _, acl := range aclv {
+		var detail string
+		switch {
+		case acl.Scheme == "":
+			detail = "empty ACL scheme"
+		case !aclSchemes[acl.Scheme]:
+			detail = fmt.Sprintf("unknown ACL scheme %q", acl.Scheme)
+		case acl.Perms&^PERM_ALL != 0:
+			detail = fmt.Sprintf("invalid ACL permissions %#x", acl.Perms)
+		default:
+			continue
+		}
+		return &Error{Op: op, Code: ZINVALIDACL, Path: path, Detail: detail}
+	}
+	return nil
+}
+
 // AuthACL produces an ACL list containing a single ACL which uses
 // the provided permissions, with the scheme "auth", and ID "", which
 // is used by ZooKeeper to represent any authenticated user.
@@ -282,14 +623,85 @@ func WorldACL(perms uint32) []ACL {
 	return []ACL{{perms, "world", "anyone"}}
 }
 
+// IPACL produces an ACL list containing a single ACL which uses the
+// provided permissions, with the scheme "ip", and the given address as
+// ID, which ZooKeeper uses to represent clients connecting from that
+// address.  The address may be a bare IPv4 or IPv6 address, or a network
+// in CIDR notation, such as "10.0.0.0/8".  An error is returned if it
+// is malformed.
+func IPACL(perms uint32, cidr string) ([]ACL, error) {
+	if strings.Contains(cidr, "/") {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("zookeeper: invalid ip ACL address %q", cidr)
+		}
+	} else if net.ParseIP(cidr) == nil {
+		return nil, fmt.Errorf("zookeeper: invalid ip ACL address %q", cidr)
+	}
+	return []ACL{{perms, "ip", cidr}}, nil
+}
+
+// NormalizeACL returns a copy of aclv with its entries sorted by scheme,
+// then id, then permissions.  The server doesn't promise to return the
+// entries of an ACL in the order they were set, so stored and desired
+// ACLs should be normalized before being compared.  See ACLEqual.
+func NormalizeACL(aclv []ACL) []ACL {
+	if aclv == nil {
+		return nil
+	}
+	normal := make([]ACL, len(aclv))
+	copy(normal, aclv)
+	sort.Slice(normal, func(i, j int) bool {
+		a, b := normal[i], normal[j]
+		if a.Scheme != b.Scheme {
+			return a.Scheme < b.Scheme
+		}
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		return a.Perms < b.Perms
+	})
+	return normal
+}
+
+// ACLEqual returns whether a and b hold the same entries,
+// regardless of their order.
+func ACLEqual(a, b []ACL) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = NormalizeACL(a), NormalizeACL(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // -----------------------------------------------------------------------
 // Event methods.
 
 // Ok returns true in case the event reports zk as being in a usable state.
 func (e Event) Ok() bool {
 	// That's really it for now. Anything else seems to mean zk
-	// can't be used at the moment.
-	return e.State == STATE_CONNECTED
+	// can't be used at the moment.  An EVENT_NOTWATCHING isn't
+	// a fired watch either, even if the connection is fine.
+	return e.State == STATE_CONNECTED && e.Type != EVENT_NOTWATCHING
+}
+
+// Err returns nil if the event is Ok, and the event itself
+// as an error otherwise.
+func (e Event) Err() error {
+	if e.Ok() {
+		return nil
+	}
+	return e
+}
+
+// Error returns the same description of the event as String,
+// so that Event implements the error interface.
+func (e Event) Error() string {
+	return e.String()
 }
 
 func (e Event) String() (s string) {
@@ -325,7 +737,7 @@ func (e Event) String() (s string) {
 	case EVENT_CHILD:
 		s += "path children changed: "
 	case EVENT_NOTWATCHING:
-		s += "not watching: " // !?
+		s += "path not watched anymore: "
 	case EVENT_SESSION:
 		// nothing
 	}
@@ -383,11 +795,58 @@ func (stat *Stat) AVersion() int {
 }
 
 // If the node is an ephemeral node, EphemeralOwner returns the session id
-// of the owner of the node; otherwise it will return zero.
+// of the owner of the node; otherwise it will return zero.  Servers
+// supporting container and TTL nodes (ZooKeeper 3.5.3 and later) also
+// use the field to mark such nodes, as reported by IsContainer and IsTTL.
 func (stat *Stat) EphemeralOwner() int64 {
 	return int64(stat.c.ephemeralOwner)
 }
 
+// Special values of the ephemeralOwner field of container and TTL nodes.
+// TTL nodes are marked with the extended type bits, which the server
+// only uses when extended types are enabled, with the time to live in
+// milliseconds in the lower bits.
+const (
+	ownerContainer    = -1 << 63
+	ownerExtendedMask = -1 << 56
+	ownerTTLMask      = 0xffff << 40
+	ownerTTLValue     = 1<<40 - 1
+)
+
+// IsEphemeral returns whether the node is an ephemeral node.
+func (stat *Stat) IsEphemeral() bool {
+	return stat.c.ephemeralOwner != 0 && !stat.IsContainer() && !stat.isExtended()
+}
+
+// IsContainer returns whether the node is a container node, which is
+// deleted by the server once its last child is deleted.  Container nodes
+// are only reported by ZooKeeper 3.5.3 and later.
+func (stat *Stat) IsContainer() bool {
+	return stat.c.ephemeralOwner == ownerContainer
+}
+
+// IsTTL returns whether the node is a TTL node, which is deleted by the
+// server after it has had no changes and no children for its time to
+// live.  TTL nodes are only reported by ZooKeeper 3.5.3 and later, when
+// the server runs with extended types enabled, which TTL nodes require.
+func (stat *Stat) IsTTL() bool {
+	return stat.isExtended() && stat.c.ephemeralOwner&ownerTTLMask == 0
+}
+
+// TTL returns the time to live of a TTL node, or zero if the
+// node isn't one.  See IsTTL.
+func (stat *Stat) TTL() time.Duration {
+	if !stat.IsTTL() {
+		return 0
+	}
+	return time.Duration(stat.c.ephemeralOwner&ownerTTLValue) * time.Millisecond
+}
+
+// isExtended returns whether ephemeralOwner holds an extended type.
+func (stat *Stat) isExtended() bool {
+	return stat.c.ephemeralOwner&ownerExtendedMask == ownerExtendedMask
+}
+
 // DataLength returns the length of the data in the node in bytes.
 func (stat *Stat) DataLength() int {
 	return int(stat.c.dataLength)
@@ -403,10 +862,119 @@ func (stat *Stat) Pzxid() int64 {
 	return int64(stat.c.pzxid)
 }
 
+// statFields holds the fields of a Stat, so that Stat
+// values may be built by code that doesn't use cgo.
+type statFields struct {
+	czxid, mzxid, pzxid         int64
+	ctime, mtime                int64
+	version, cversion, aversion int32
+	ephemeralOwner              int64
+	dataLength, numChildren     int32
+}
+
+// stat returns a new Stat holding the given fields.
+func (f *statFields) stat() *Stat {
+	stat := &Stat{}
+	stat.c.czxid = C.int64_t(f.czxid)
+	stat.c.mzxid = C.int64_t(f.mzxid)
+	stat.c.pzxid = C.int64_t(f.pzxid)
+	stat.c.ctime = C.int64_t(f.ctime)
+	stat.c.mtime = C.int64_t(f.mtime)
+	stat.c.version = C.int32_t(f.version)
+	stat.c.cversion = C.int32_t(f.cversion)
+	stat.c.aversion = C.int32_t(f.aversion)
+	stat.c.ephemeralOwner = C.int64_t(f.ephemeralOwner)
+	stat.c.dataLength = C.int32_t(f.dataLength)
+	stat.c.numChildren = C.int32_t(f.numChildren)
+	return stat
+}
+
+// StatSize is the length of the data returned by Stat.Bytes.
+const StatSize = C.sizeof_struct_Stat
+
+// Bytes returns a copy of the memory of the C struct Stat underlying
+// stat, as laid out by libzookeeper, for interoperating with other C
+// code or for storing it.  The layout depends on the platform, so the
+// data is only meaningful to programs running on the same one.
+func (stat *Stat) Bytes() []byte {
+	return C.GoBytes(unsafe.Pointer(&stat.c), StatSize)
+}
+
+// StatFromBytes returns a Stat holding data previously obtained from
+// Stat.Bytes.  It is an error if data isn't StatSize bytes long.
+func StatFromBytes(data []byte) (*Stat, error) {
+	if len(data) != StatSize {
+		return nil, fmt.Errorf("zookeeper: stat data has %d bytes, want %d", len(data), StatSize)
+	}
+	var stat Stat
+	copy((*[StatSize]byte)(unsafe.Pointer(&stat.c))[:], data)
+	return &stat, nil
+}
+
 // -----------------------------------------------------------------------
 // Functions and methods related to ZooKeeper itself.
 
-const bufferSize = 1024 * 1024
+// DefaultClientBufferSize is the size of the buffer used by default to
+// read the data of a node.  It matches the default jute.maxbuffer
+// setting of ZooKeeper servers, which bounds the size of node data.
+const DefaultClientBufferSize = 1024 * 1024
+
+var clientBufferSizeMutex sync.Mutex
+var clientBufferSize = DefaultClientBufferSize
+
+// SetClientBufferSize changes the size of the buffer allocated by each
+// Get and GetW operation to hold the data read from a node.  Embedders
+// that are short on memory and only deal with small nodes may shrink it,
+// while servers configured with a jute.maxbuffer larger than the default
+// need it grown to match.  Data larger than the buffer is truncated by
+// libzookeeper, so the buffer must be at least as large as the largest
+// node read.  If n is not positive, DefaultClientBufferSize is restored.
+func SetClientBufferSize(n int) {
+	if n <= 0 {
+		n = DefaultClientBufferSize
+	}
+	clientBufferSizeMutex.Lock()
+	clientBufferSize = n
+	clientBufferSizeMutex.Unlock()
+}
+
+func getClientBufferSize() int {
+	clientBufferSizeMutex.Lock()
+	defer clientBufferSizeMutex.Unlock()
+	return clientBufferSize
+}
+
+// Names of the optional features accepted by Supported.
+const (
+	FEATURE_MULTI          = "multi"
+	FEATURE_TTL            = "ttl"
+	FEATURE_CONFIG         = "config"
+	FEATURE_REMOVE_WATCHES = "removewatches"
+	FEATURE_ADD_WATCH      = "addwatch"
+)
+
+// Supported returns whether the ZooKeeper C library the program is
+// running against provides the given feature (one of the FEATURE_*
+// constants).  Some features are only available in newer versions of
+// libzookeeper.  The functions backing them are referenced weakly, so
+// that gozk may still be linked and loaded against older versions, and
+// their presence is probed for at runtime.  Operations relying on a
+// feature that is not supported fail with a ZUNIMPLEMENTED error.
+func Supported(feature string) bool {
+	switch feature {
+	case FEATURE_MULTI:
+		return C.have_zoo_multi() != 0
+	case FEATURE_TTL:
+		return C.have_zoo_create2_ttl() != 0
+	case FEATURE_CONFIG:
+		return C.have_zoo_getconfig() != 0
+	case FEATURE_REMOVE_WATCHES:
+		return C.have_zoo_remove_watchers() != 0
+	case FEATURE_ADD_WATCH:
+		return C.have_zoo_add_watch() != 0
+	}
+	return false
+}
 
 // SetLogLevel changes the minimum level of logging output generated
 // to adjust the amount of information provided.
@@ -414,6 +982,48 @@ func SetLogLevel(level int) {
 	C.zoo_set_debug_level(C.ZooLogLevel(level))
 }
 
+// Logger is implemented by the loggers that SetLogger accepts.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+var loggerMutex sync.Mutex
+var logger Logger = nopLogger{}
+
+// SetLogger sets the logger that significant events observed by the
+// Go side of gozk are reported to: session state changes, reconnections,
+// session channels falling behind, and panics recovered from by the
+// watch loop.  Messages about a connection include its Id.  The output
+// of the C library is controlled separately, with SetLogLevel.  Passing
+// nil discards the messages, which is the default.
+//
+// The logger may be called while gozk holds internal locks, so it must
+// not block for long, nor call back into gozk.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	loggerMutex.Lock()
+	logger = l
+	loggerMutex.Unlock()
+}
+
+func getLogger() Logger {
+	loggerMutex.Lock()
+	defer loggerMutex.Unlock()
+	return logger
+}
+
 // Dial initializes the communication with a ZooKeeper cluster. The provided
 // servers parameter may include multiple server addresses, separated
 // by commas, so that the client will automatically attempt to connect
@@ -429,51 +1039,301 @@ func SetLogLevel(level int) {
 // to the state of the established connection happens.  See the documentation
 // for the Event type for more details.
 func Dial(servers string, recvTimeout time.Duration) (*Conn, <-chan Event, error) {
-	return dial(servers, recvTimeout, nil)
+	return dial(servers, recvTimeout, nil, 0, false)
 }
 
 // Redial is equivalent to Dial, but attempts to reestablish an existing session
 // identified via the clientId parameter.
 func Redial(servers string, recvTimeout time.Duration, clientId *ClientId) (*Conn, <-chan Event, error) {
-	return dial(servers, recvTimeout, clientId)
+	return dial(servers, recvTimeout, clientId, 0, false)
+}
+
+// DialFlags is equivalent to Dial, but passes the provided flags to the
+// underlying zookeeper_init call.  The flags may be a combination of the
+// READONLY constant and any other value accepted by the C library, which
+// allows the use of features not yet wrapped by this package.
+func DialFlags(servers string, recvTimeout time.Duration, flags int) (*Conn, <-chan Event, error) {
+	return dial(servers, recvTimeout, nil, flags, false)
+}
+
+// DialIsolated is equivalent to Dial, but events for the new connection
+// are dispatched by a watch loop of its own rather than by the loop
+// shared among all other connections.  A connection established this
+// way doesn't get its events delayed by other connections, and when
+// the application fails to collect events quickly enough from it, all
+// of its event channels are closed with CLOSE_BUFFER_FULL as their
+// CloseReason instead of the whole process panicking.
+func DialIsolated(servers string, recvTimeout time.Duration) (*Conn, <-chan Event, error) {
+	return dial(servers, recvTimeout, nil, 0, true)
+}
+
+// DialPinned is equivalent to Dial, but connects to the single server
+// at the given host:port address, optionally followed by a chroot path.
+// Listing several servers is an error.  Such a connection gives up the
+// automatic failover of the C library: if the server goes away, the
+// session can only be recovered by that same server coming back before
+// the session expires.  This is mostly useful in tests, to direct reads
+// at a particular member of the ensemble, such as a lagging follower.
+// A host name resolving to several addresses may still be connected to
+// through any of them.
+func DialPinned(server string, recvTimeout time.Duration) (*Conn, <-chan Event, error) {
+	if err := ValidateServers(server); err != nil {
+		return nil, nil, err
+	}
+	hosts := server
+	if i := strings.Index(server, "/"); i >= 0 {
+		hosts = server[:i]
+	}
+	if strings.Contains(hosts, ",") {
+		return nil, nil, fmt.Errorf("zookeeper: cannot pin connection to several servers: %q", server)
+	}
+	return dial(server, recvTimeout, nil, 0, false)
+}
+
+// DialWithAuth is equivalent to Dial, but also adds the given
+// authentication certificate to the connection, as done by AddAuth,
+// before returning it, so that no operation may ever run without it.
+// It blocks until the session is established and the authentication
+// is processed by the server.  If authentication fails, the connection
+// is closed and the error is returned.
+func DialWithAuth(servers string, recvTimeout time.Duration, scheme, cert string) (*Conn, <-chan Event, error) {
+	conn, watch, err := dial(servers, recvTimeout, nil, 0, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := conn.AddAuth(scheme, cert); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, watch, nil
 }
 
-func dial(servers string, recvTimeout time.Duration, clientId *ClientId) (*Conn, <-chan Event, error) {
-	conn := &Conn{}
+func dial(servers string, recvTimeout time.Duration, clientId *ClientId, flags int, isolated bool) (*Conn, <-chan Event, error) {
+	conn := &Conn{id: newConnId(), servers: servers}
 	conn.watchChannels = make(map[uintptr]chan Event)
+	conn.watchCallbacks = make(map[uintptr]func(Event))
+	conn.authFailed = make(chan struct{})
 
 	var cId *C.clientid_t
 	if clientId != nil {
 		cId = &clientId.cId
 	}
 
+	conn.watchLoop = sharedWatchLoop
+	if isolated {
+		conn.watchLoop = newWatchLoop()
+	}
+
 	watchId, watchChannel := conn.createWatch(true)
 	conn.sessionWatchId = watchId
 
+	conn.context = C.create_conn_context(conn.watchLoop.queue, C.ulong(watchId))
+	if conn.context == nil {
+		panic("Failed to create connection context")
+	}
+
 	cservers := C.CString(servers)
-	handle, cerr := C.zookeeper_init_int(cservers, C.watch_handler, C.int(recvTimeout/1e6), cId, C.ulong(watchId), 0)
+	handle, cerr := C.zookeeper_init_int(cservers, C.watch_handler, C.int(recvTimeout/1e6), cId, conn.context, C.int(flags))
 	C.free(unsafe.Pointer(cservers))
 	if handle == nil {
-		conn.closeAllWatches()
+		conn.closeAllWatches(CLOSE_CONNECTION)
+		C.free(unsafe.Pointer(conn.context))
+		if isolated {
+			C.destroy_watch_queue(conn.watchLoop.queue)
+		}
 		return nil, nil, zkError(C.int(ZSYSTEMERROR), cerr, "dial", "")
 	}
 
 	conn.handle = handle
-	runWatchLoop()
+	conn.watchLoop.run()
 	return conn, watchChannel, nil
 }
 
+// newConnId returns a short random token identifying a Conn.
+func newConnId() string {
+	var b [6]byte
+	if _, err := crand.Read(b[:]); err != nil {
+		// Unlikely, and the id is only meant for telling logs apart.
+		binary.BigEndian.PutUint32(b[:], rand.Uint32())
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// WaitConnected reads events from watch, the session channel returned
+// by one of the Dial functions, until the session is connected, and
+// returns a channel delivering the events that follow, so that ranging
+// over it starts clean.  If the session fails to authenticate or
+// expires, the channel is closed, or the timeout expires before the
+// session is connected, the respective error is returned instead,
+// with codes ZAUTHFAILED, ZSESSIONEXPIRED, ZCLOSING and
+// ZOPERATIONTIMEOUT.  The events read until then are discarded.
+//
+// Once WaitConnected returns successfully, watch must not be read from
+// anymore, since a goroutine relays its events to the returned channel
+// until it's closed.
+func WaitConnected(watch <-chan Event, timeout time.Duration) (remaining <-chan Event, err error) {
+	expired := time.After(timeout)
+	for {
+		var event Event
+		var ok bool
+		select {
+		case event, ok = <-watch:
+		case <-expired:
+			return nil, zkError(C.int(ZOPERATIONTIMEOUT), nil, "waitconnected", "")
+		}
+		if !ok {
+			event.State = STATE_CLOSED
+		}
+		switch event.State {
+		case STATE_CONNECTED:
+			relay := make(chan Event, cap(watch))
+			go func() {
+				for event := range watch {
+					relay <- event
+				}
+				close(relay)
+			}()
+			return relay, nil
+		case STATE_CONNECTING, STATE_ASSOCIATING:
+			continue
+		}
+		return nil, eventError(event, "waitconnected", "")
+	}
+}
+
+// ValidateServers checks that servers is a well formed server list as
+// accepted by Dial: a comma separated list of host:port pairs, optionally
+// followed by a chroot path, as in "host1:2181,host2:2181/app".  The
+// returned error identifies the offending entry, which is more helpful
+// than the errno that the C library would report when dialing.
+func ValidateServers(servers string) error {
+	hosts := servers
+	if i := strings.Index(servers, "/"); i >= 0 {
+		hosts = servers[:i]
+		if err := validateChroot(servers[i:]); err != nil {
+			return fmt.Errorf("zookeeper: invalid chroot %q: %v", servers[i:], err)
+		}
+	}
+	if hosts == "" {
+		return fmt.Errorf("zookeeper: no servers in %q", servers)
+	}
+	for _, hostPort := range strings.Split(hosts, ",") {
+		if err := validateHostPort(hostPort); err != nil {
+			return fmt.Errorf("zookeeper: invalid server %q: %v", hostPort, err)
+		}
+	}
+	return nil
+}
+
+func validateHostPort(hostPort string) error {
+	if hostPort == "" {
+		return errors.New("empty server address")
+	}
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		if !strings.Contains(hostPort, ":") {
+			return errors.New("missing port")
+		}
+		return err
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("bad port %q", port)
+	}
+	return nil
+}
+
+func validateChroot(chroot string) error {
+	if chroot == "/" {
+		return nil
+	}
+	if strings.HasSuffix(chroot, "/") {
+		return errors.New("trailing slash")
+	}
+	for _, name := range strings.Split(chroot[1:], "/") {
+		switch name {
+		case "":
+			return errors.New("empty path element")
+		case ".", "..":
+			return fmt.Errorf("relative path element %q", name)
+		}
+	}
+	return nil
+}
+
+// ValidatePath checks path against the rules ZooKeeper enforces for node
+// paths, returning a ZBADARGUMENTS error whose Detail explains the
+// violation, if any.  Operations on invalid paths fail with ZBADARGUMENTS
+// too, but with no explanation.  Paths must be absolute, must not end
+// with a slash unless they're the root, and must not hold empty or
+// relative elements, nor null or otherwise invalid characters.
+//
+// Paths under /zookeeper are valid: the server reserves that subtree for
+// itself, and refuses changes there, but it may be read from.
+func ValidatePath(path string) error {
+	return validatePath("validatepath", path)
+}
+
+func validatePath(op, path string) error {
+	bad := func(detail string) error {
+		return &Error{Op: op, Code: ZBADARGUMENTS, Path: path, Detail: detail}
+	}
+	switch {
+	case path == "":
+		return bad("path is empty")
+	case path[0] != '/':
+		return bad("path must start with /")
+	case path == "/":
+		return nil
+	case strings.HasSuffix(path, "/"):
+		return bad("path must not end with /")
+	case !utf8.ValidString(path):
+		return bad("path is not valid UTF-8")
+	}
+	for _, name := range strings.Split(path[1:], "/") {
+		switch name {
+		case "":
+			return bad("path must not contain empty elements")
+		case ".", "..":
+			return bad(fmt.Sprintf("path must not contain relative element %q", name))
+		}
+	}
+	for _, r := range path {
+		switch {
+		case r == 0:
+			return bad("path must not contain null characters")
+		case r < 0x20, r >= 0x7f && r <= 0x9f, r >= 0xd800 && r <= 0xf8ff, r >= 0xfff0:
+			return bad(fmt.Sprintf("path must not contain character %U", r))
+		}
+	}
+	return nil
+}
+
 // SetServersResolutionDelay sets how long the client should wait before re-resolving the zookeeper's hostnames.
 // Setting this to any value larger than 0 will cause gozk to query DNS periodically for the zookeeper hostnames
 // it's been configured with. For example, setting this to `2 * times.Second` will trigger a DNS lookup every 2
 // seconds.
 // The default is `0` and means hostnames won't be re-resolved.
 func (conn *Conn) SetServersResolutionDelay(delay time.Duration) {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return
+	}
 	C.zoo_set_servers_resolution_delay(conn.handle, C.int(delay.Milliseconds()))
 }
 
-// ConnectedServer returns the ip and port of the current server connection.
+// ConnectedServer returns the ip and port of the current server connection,
+// or the empty string if conn is closed.
 func (conn *Conn) ConnectedServer() string {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return ""
+	}
 	ptr := C.zoo_get_current_server(conn.handle)
 	// Note, ptr does not have to be freed because it's statically allocated in https://github.com/apache/zookeeper/blob/50d5722dd3342530eae4a737d9759ec5f774c84b/zookeeper-client/zookeeper-client-c/src/zookeeper.c#L5114
 	return C.GoString(ptr)
@@ -481,7 +1341,11 @@ func (conn *Conn) ConnectedServer() string {
 
 // CurrentServer returns the IP and port of the currently connected zookeeper server or an error.
 func (conn *Conn) CurrentServer() (string, error) {
-
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return "", closingError("currentserver", "")
+	}
 	addr := &syscall.RawSockaddrInet4{}
 	sizeof := syscall.SizeofSockaddrInet4
 
@@ -492,58 +1356,540 @@ func (conn *Conn) CurrentServer() (string, error) {
 	return fmt.Sprintf("%d.%d.%d.%d:%d", addr.Addr[0], addr.Addr[1], addr.Addr[2], addr.Addr[3], addr.Port), nil
 }
 
-func (conn *Conn) SetServers(servers string) {
-	C.zoo_set_servers(conn.handle, C.CString(servers))
+// ConnSessionInfo holds the parameters of the session established by
+// a connection, as seen by the client.
+type ConnSessionInfo struct {
+	// Id is the session id.
+	Id int64
+
+	// Timeout is the session timeout negotiated with the server.
+	Timeout time.Duration
+
+	// Server is the address of the server the session is connected
+	// to, as resolved by the C library, such as "127.0.0.1:2181".
+	Server string
 }
 
-// ClientId returns the client ID for the existing session with ZooKeeper.
-// This is useful to reestablish an existing session via ReInit.
-func (conn *Conn) ClientId() *ClientId {
+// SessionInfo returns the parameters of the session established by
+// conn: its id, the session timeout negotiated with the server, and
+// the address of the server it is connected to, which are useful to
+// record when the session is established.  It fails with
+// ZINVALIDSTATE unless the session is currently connected.
+func (conn *Conn) SessionInfo() (ConnSessionInfo, error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
-	return &ClientId{*C.zoo_client_id(conn.handle)}
+	if conn.handle == nil {
+		return ConnSessionInfo{}, closingError("sessioninfo", "")
+	}
+	if int(C.zoo_state(conn.handle)) != STATE_CONNECTED {
+		return ConnSessionInfo{}, &Error{Op: "sessioninfo", Code: ZINVALIDSTATE, Detail: "session not connected"}
+	}
+	return ConnSessionInfo{
+		Id:      int64(C.zoo_client_id(conn.handle).client_id),
+		Timeout: time.Duration(C.zoo_recv_timeout(conn.handle)) * time.Millisecond,
+		Server:  C.GoString(C.zoo_get_current_server(conn.handle)),
+	}, nil
 }
 
-// Close terminates the ZooKeeper interaction.
-func (conn *Conn) Close() error {
+// Id returns a short token assigned to conn when it was dialed, which
+// tells apart the log messages of several connections made by the same
+// process.  It doesn't change as conn reconnects or moves to other
+// servers, and it remains available after conn is closed.  The id is
+// random, and unrelated to the session id.
+func (conn *Conn) Id() string {
+	return conn.id
+}
 
-	// Protect from concurrency around conn.handle change.
-	conn.mutex.Lock()
-	defer conn.mutex.Unlock()
+// State returns the current state of the session established by conn,
+// as one of the STATE_* constants, or STATE_CLOSED if conn is closed.
+func (conn *Conn) State() int {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return STATE_CLOSED
+	}
+	return int(C.zoo_state(conn.handle))
+}
 
+// RecvTimeout returns the session timeout negotiated with the server,
+// or the one requested if the session hasn't been established yet.
+// It returns zero if conn is closed.
+func (conn *Conn) RecvTimeout() time.Duration {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
-		// ZooKeeper may hang indefinitely if a handler is closed twice,
-		// so we get in the way and prevent it from happening.
-		return closingError("close", "")
+		return 0
 	}
-	rc, cerr := C.zookeeper_close(conn.handle)
+	return time.Duration(C.zoo_recv_timeout(conn.handle)) * time.Millisecond
+}
 
-	conn.closeAllWatches()
-	stopWatchLoop()
+// IsUnrecoverable returns whether the session established by conn
+// can't be recovered anymore, as when it has expired or failed to
+// authenticate, in which case conn must be closed and a new one
+// dialed.  It returns false if conn is closed.
+func (conn *Conn) IsUnrecoverable() bool {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return false
+	}
+	return C.is_unrecoverable(conn.handle) == C.ZINVALIDSTATE
+}
 
-	// At this point, nothing else should need conn.handle.
-	conn.handle = nil
+// LibStats holds the counters kept internally by the C library
+// for a connection.  See Conn.LibStats.
+type LibStats struct {
+	// OutstandingRequests is the number of requests sent to the
+	// server which haven't been answered yet.
+	OutstandingRequests int
 
-	return zkError(rc, cerr, "close", "")
+	// LastPingRTT is the round trip time of the last ping
+	// made by the library to keep the session alive.
+	LastPingRTT time.Duration
 }
 
-// Get returns the data and status from an existing node.  err will be nil,
-// unless an error is found. Attempting to retrieve data from a non-existing
-// node is an error.
-func (conn *Conn) Get(path string) (data string, stat *Stat, err error) {
+// LibStats returns the counters kept internally by the C library for
+// conn.  No released version of libzookeeper exports them, though, so
+// LibStats fails with ZUNIMPLEMENTED while conn is open, and with
+// ZCLOSING once it's closed.  Conn.Ping measures the round trip time
+// to the server, and Conn.Health reports the client side view of the
+// connection in the meantime.
+func (conn *Conn) LibStats() (LibStats, error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
-		return "", nil, closingError("get", path)
+		return LibStats{}, closingError("libstats", "")
 	}
+	return LibStats{}, &Error{Op: "libstats", Code: ZUNIMPLEMENTED, Detail: "libzookeeper doesn't export its statistics"}
+}
 
-	cpath := C.CString(path)
-	cbuffer := (*C.char)(C.malloc(bufferSize))
-	cbufferLen := C.int(bufferSize)
-	defer C.free(unsafe.Pointer(cpath))
-	defer C.free(unsafe.Pointer(cbuffer))
+// HealthReport is a snapshot of the condition of a connection,
+// as returned by Conn.Health.
+type HealthReport struct {
+	Id                string        // See Conn.Id.
+	State             int           // One of the STATE_* constants.
+	Connected         bool          // Whether State is STATE_CONNECTED.
+	NegotiatedTimeout time.Duration // The session timeout.
+	PendingWatches    int           // See Conn.PendingWatches.
+	Unrecoverable     bool          // See Conn.IsUnrecoverable.
+	ReconnectCount    int64         // See Conn.ReconnectCount.
+	LastError         error         // The last error returned by an operation.
+}
 
-	var cstat Stat
+// Health returns a snapshot of the condition of conn, suitable for
+// reporting on health check endpoints.  It's cheap, and may be called
+// at any time, including after conn is closed, in which case State is
+// STATE_CLOSED.  The fields are read independently of each other, so
+// they may be slightly inconsistent if conn changes state meanwhile.
+func (conn *Conn) Health() HealthReport {
+	state := conn.State()
+	return HealthReport{
+		Id:                conn.id,
+		State:             state,
+		Connected:         state == STATE_CONNECTED,
+		NegotiatedTimeout: conn.RecvTimeout(),
+		PendingWatches:    conn.PendingWatches(),
+		Unrecoverable:     conn.IsUnrecoverable(),
+		ReconnectCount:    conn.ReconnectCount(),
+		LastError:         conn.breaker.lastError(),
+	}
+}
+
+func (conn *Conn) SetServers(servers string) {
+	// The write lock protects conn.servers as well as conn.handle.
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.handle == nil {
+		return
+	}
+	conn.servers = servers
+	C.zoo_set_servers(conn.handle, C.CString(servers))
+}
+
+// ClientId returns the client ID for the existing session with ZooKeeper.
+// This is useful to reestablish an existing session via ReInit.
+// It returns nil if conn is closed.
+func (conn *Conn) ClientId() *ClientId {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return nil
+	}
+	return &ClientId{*C.zoo_client_id(conn.handle)}
+}
+
+// OwnsNode returns whether the node with the given status is an
+// ephemeral node owned by the session established by conn.
+func (conn *Conn) OwnsNode(stat *Stat) bool {
+	clientId := conn.ClientId()
+	return clientId != nil && stat.IsEphemeral() && stat.EphemeralOwner() == clientId.SessionId()
+}
+
+// Close terminates the ZooKeeper interaction.
+func (conn *Conn) Close() error {
+
+	conn.SetPingInterval(0)
+
+	// Protect from concurrency around conn.handle change.
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.handle == nil {
+		// ZooKeeper may hang indefinitely if a handler is closed twice,
+		// so we get in the way and prevent it from happening.
+		return closingError("close", "")
+	}
+	rc, cerr := C.zookeeper_close(conn.handle)
+
+	conn.closeAllWatches(CLOSE_CONNECTION)
+	conn.watchLoop.stop()
+
+	// At this point, nothing else should need conn.handle
+	// or the context handed to the watch handler.
+	conn.handle = nil
+	C.free(unsafe.Pointer(conn.context))
+	conn.context = nil
+
+	return zkError(rc, cerr, "close", "")
+}
+
+// CloseTimeout works like Close, but gives up waiting for the C library
+// to terminate the session after the given timeout, which may happen if
+// the network is wedged.  In that case, the connection is torn down on
+// the Go side anyway, with all of its event channels closed as usual,
+// and a ZOPERATIONTIMEOUT error is returned.  Note that the underlying
+// close may still be in progress in the background at that point, and
+// the resources it holds, including its socket, are only released when
+// it finally returns, or otherwise when the process exits.
+func (conn *Conn) CloseTimeout(timeout time.Duration) error {
+
+	// Protect from concurrency around conn.handle change.
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.handle == nil {
+		return closingError("close", "")
+	}
+	handle, context, loop := conn.handle, conn.context, conn.watchLoop
+	done := make(chan error, 1)
+	go func() {
+		rc, cerr := C.zookeeper_close(handle)
+		// The watch handler may use the watch loop and
+		// the context until zookeeper_close returns.
+		loop.stop()
+		C.free(unsafe.Pointer(context))
+		done <- zkError(rc, cerr, "close", "")
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(timeout):
+		err = zkError(C.int(ZOPERATIONTIMEOUT), nil, "close", "")
+	}
+	conn.closeAllWatches(CLOSE_CONNECTION)
+	conn.handle = nil
+	conn.context = nil
+	return err
+}
+
+// SetDefaultOpTimeout bounds how long Get, Children, Exists, Create,
+// CreateTTL, Set and Delete wait for the server to reply, so that they
+// may fail sooner than the session timeout would have them.  Once the
+// timeout expires, a ZOPERATIONTIMEOUT error is returned, while the
+// session is left alone.  The request isn't canceled, though: it's still
+// carried out, and may well take effect on the server, with its result
+// being discarded.  Close waits for such requests to complete.
+// Each of them holds a thread while it's pending, so once too many
+// have piled up further operations fail with ZOPERATIONTIMEOUT right
+// away, until some of the earlier ones complete.
+// A timeout of zero, the default, disables the bound.
+func (conn *Conn) SetDefaultOpTimeout(timeout time.Duration) {
+	conn.opTimeoutMutex.Lock()
+	defer conn.opTimeoutMutex.Unlock()
+	conn.opTimeout = timeout
+}
+
+// maxAbandonedOps bounds the number of requests that outlived the
+// timeout set with SetDefaultOpTimeout and are still pending.
+const maxAbandonedOps = 64
+
+// withOpTimeout runs f, which performs the operation op on path, and
+// waits for it to return for up to the timeout set with
+// SetDefaultOpTimeout.  f keeps running once the timeout expires,
+// so whatever it stores must only be used if it returned in time.
+func (conn *Conn) withOpTimeout(op, path string, f func() error) error {
+	conn.opTimeoutMutex.Lock()
+	timeout, abandoned := conn.opTimeout, conn.abandonedOps
+	conn.opTimeoutMutex.Unlock()
+	if timeout <= 0 {
+		return f()
+	}
+	if abandoned >= maxAbandonedOps {
+		return &Error{Op: op, Code: ZOPERATIONTIMEOUT, Path: path, Detail: "too many earlier requests still pending"}
+	}
+	// gaveUp is guarded by conn.opTimeoutMutex, as is
+	// sending on done, so that the outcome is decided once.
+	gaveUp := false
+	done := make(chan error, 1)
+	go func() {
+		err := f()
+		conn.opTimeoutMutex.Lock()
+		if gaveUp {
+			conn.abandonedOps--
+		}
+		done <- err
+		conn.opTimeoutMutex.Unlock()
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+	conn.opTimeoutMutex.Lock()
+	defer conn.opTimeoutMutex.Unlock()
+	select {
+	case err := <-done:
+		return err
+	default:
+	}
+	gaveUp = true
+	conn.abandonedOps++
+	return zkError(C.int(ZOPERATIONTIMEOUT), nil, op, path)
+}
+
+// AuthFailed returns a channel that is closed once a session event
+// reporting STATE_AUTH_FAILED is observed for conn.  Once that happens,
+// the session is effectively unusable, with operations failing with
+// ZAUTHFAILED or ZNOAUTH errors, and conn should be closed.  This allows
+// security sensitive applications to tear down the connection promptly
+// rather than discovering the problem on each operation.
+func (conn *Conn) AuthFailed() <-chan struct{} {
+	return conn.authFailed
+}
+
+// SetMaxInFlight limits the number of asynchronous operations (those
+// waiting on a completion from the C library, such as AddAuth) that
+// may be outstanding on conn at any one time.  Once n operations are
+// pending, further ones block until an earlier one completes.  A value
+// of n less than or equal to zero removes the limit, which is the default.
+//
+// The limit applies per connection.  Operations already outstanding
+// when the limit changes are accounted against the previous limit.
+func (conn *Conn) SetMaxInFlight(n int) {
+	conn.inFlightMutex.Lock()
+	defer conn.inFlightMutex.Unlock()
+	if n <= 0 {
+		conn.inFlight = nil
+	} else {
+		conn.inFlight = make(chan bool, n)
+	}
+}
+
+// startInFlight blocks until an asynchronous operation may be started
+// under the limit set by SetMaxInFlight, and returns the value that
+// must be handed to doneInFlight once the operation completes.
+func (conn *Conn) startInFlight() chan bool {
+	conn.inFlightMutex.Lock()
+	inFlight := conn.inFlight
+	conn.inFlightMutex.Unlock()
+	if inFlight != nil {
+		inFlight <- true
+	}
+	return inFlight
+}
+
+// doneInFlight releases the slot obtained with startInFlight.
+func doneInFlight(inFlight chan bool) {
+	if inFlight != nil {
+		<-inFlight
+	}
+}
+
+// tryStartInFlight works like startInFlight, but rather than blocking
+// until an operation may be started it returns false right away.
+func (conn *Conn) tryStartInFlight() (chan bool, bool) {
+	conn.inFlightMutex.Lock()
+	inFlight := conn.inFlight
+	conn.inFlightMutex.Unlock()
+	if inFlight == nil {
+		return nil, true
+	}
+	select {
+	case inFlight <- true:
+		return inFlight, true
+	default:
+		return nil, false
+	}
+}
+
+// asyncBatch issues a batch of asynchronous requests, such as those of
+// SetMany, under the limit set by SetMaxInFlight, and collects their
+// completions in the order they were issued.
+type asyncBatch struct {
+	conn    *Conn
+	pending []pendingRequest
+}
+
+type pendingRequest struct {
+	data     *C.completion_data
+	inFlight chan bool
+	done     func(rc C.int, cerr error, data *C.completion_data)
+}
+
+// start returns the completion data for the next request of the batch,
+// once it may be issued.  While no slot is free, the oldest outstanding
+// request of the batch is waited for rather than the slot itself, so
+// that concurrent batches never block each other while holding slots.
+func (b *asyncBatch) start() (*C.completion_data, chan bool) {
+	for {
+		inFlight, ok := b.conn.tryStartInFlight()
+		if ok {
+			return newCompletionData(), inFlight
+		}
+		if len(b.pending) == 0 {
+			return newCompletionData(), b.conn.startInFlight()
+		}
+		b.waitOne()
+	}
+}
+
+// issued records that the request started with data was issued, with
+// the result code rc and system error cerr.  If the request was accepted,
+// done is called with its result code and completion data once it
+// completes.  Otherwise it is called right away with rc and cerr, and
+// nil completion data.
+func (b *asyncBatch) issued(rc C.int, cerr error, data *C.completion_data, inFlight chan bool, done func(rc C.int, cerr error, data *C.completion_data)) {
+	if rc != C.ZOK {
+		C.destroy_completion_data(data)
+		doneInFlight(inFlight)
+		done(rc, cerr, nil)
+		return
+	}
+	b.pending = append(b.pending, pendingRequest{data, inFlight, done})
+}
+
+// waitOne waits for the oldest outstanding request of the batch.
+func (b *asyncBatch) waitOne() {
+	p := b.pending[0]
+	b.pending = b.pending[1:]
+	C.wait_for_completion(p.data)
+	doneInFlight(p.inFlight)
+	p.done(C.int(uintptr(p.data.data)), nil, p.data)
+	C.destroy_completion_data(p.data)
+}
+
+// wait waits for all the outstanding requests of the batch.
+func (b *asyncBatch) wait() {
+	for len(b.pending) > 0 {
+		b.waitOne()
+	}
+}
+
+func newCompletionData() *C.completion_data {
+	data := C.create_completion_data()
+	if data == nil {
+		panic("Failed to create completion data")
+	}
+	return data
+}
+
+// ExpireSession forces the expiration of the session established by
+// conn, and blocks until conn observes it.  This is done by
+// establishing a second connection to the same session and closing
+// it, as described in the ZooKeeper FAQ, so it is mostly useful for
+// testing how an application handles the STATE_EXPIRED_SESSION event.
+func (conn *Conn) ExpireSession() error {
+	conn.mutex.RLock()
+	if conn.handle == nil {
+		conn.mutex.RUnlock()
+		return closingError("expiresession", "")
+	}
+	servers := conn.servers
+	clientId := &ClientId{*C.zoo_client_id(conn.handle)}
+	timeout := time.Duration(C.zoo_recv_timeout(conn.handle)) * time.Millisecond
+	conn.mutex.RUnlock()
+
+	conn2, session2, err := Redial(servers, timeout, clientId)
+	if err != nil {
+		return err
+	}
+	select {
+	case event := <-session2:
+		if !event.Ok() {
+			conn2.Close()
+			return fmt.Errorf("zookeeper: expiresession: cannot connect to session: %v", event)
+		}
+	case <-time.After(timeout):
+		conn2.Close()
+		return fmt.Errorf("zookeeper: expiresession: timeout connecting to session")
+	}
+	// Perform a round trip so that the server has certainly
+	// processed the new connection before the session is closed.
+	if _, err := conn2.Exists("/"); err != nil {
+		conn2.Close()
+		return err
+	}
+	if err := conn2.Close(); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(3 * timeout)
+	for {
+		conn.mutex.RLock()
+		if conn.handle == nil {
+			conn.mutex.RUnlock()
+			return closingError("expiresession", "")
+		}
+		state := int(C.zoo_state(conn.handle))
+		conn.mutex.RUnlock()
+		if state == STATE_EXPIRED_SESSION {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("zookeeper: expiresession: session not expired after %v", 3*timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Get returns the data and status from an existing node.  err will be nil,
+// unless an error is found. Attempting to retrieve data from a non-existing
+// node is an error.
+func (conn *Conn) Get(path string) (data string, stat *Stat, err error) {
+	var d string
+	var st *Stat
+	err = conn.withOpTimeout("get", path, func() (err error) {
+		d, st, err = conn.get(path)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return d, st, nil
+}
+
+func (conn *Conn) get(path string) (data string, stat *Stat, err error) {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return "", nil, closingError("get", path)
+	}
+	if err = conn.breaker.allow(); err != nil {
+		return "", nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
+
+	cpath := C.CString(path)
+	bufferSize := getClientBufferSize()
+	cbuffer := (*C.char)(C.malloc(C.size_t(bufferSize)))
+	cbufferLen := C.int(bufferSize)
+	defer C.free(unsafe.Pointer(cpath))
+	defer C.free(unsafe.Pointer(cbuffer))
+
+	var cstat Stat
 	rc, cerr := C.zoo_wget(conn.handle, cpath, nil, nil, cbuffer, &cbufferLen, &cstat.c)
 	if rc != C.ZOK {
 		return "", nil, zkError(rc, cerr, "get", path)
@@ -556,47 +1902,260 @@ func (conn *Conn) Get(path string) (data string, stat *Stat, err error) {
 	return result, &cstat, nil
 }
 
+// ReadLevel determines the consistency of reads made with GetConsistent.
+type ReadLevel int
+
+const (
+	// READ_LOCAL reads are served by the server the session is
+	// connected to, which may lag behind the leader.
+	READ_LOCAL ReadLevel = iota
+
+	// READ_LINEARIZABLE reads are preceded by a Sync, so that they
+	// reflect all the writes committed before the read was issued.
+	READ_LINEARIZABLE
+)
+
+// GetConsistent works like Get, with the consistency determined by
+// level.  Plain Get calls are READ_LOCAL reads: they are served by the
+// server the session is connected to, which may not have seen writes
+// already committed by the leader, such as those made by other clients
+// through other servers.  READ_LINEARIZABLE reads first Sync the path,
+// waiting for the server to catch up with the leader, so they cost an
+// additional round trip through the leader.
+func (conn *Conn) GetConsistent(path string, level ReadLevel) (data string, stat *Stat, err error) {
+	if level == READ_LINEARIZABLE {
+		if err := conn.Sync(path); err != nil {
+			return "", nil, err
+		}
+	}
+	return conn.Get(path)
+}
+
+// Sync waits for the server the session is connected to to catch up
+// with the leader of the ensemble, so that reads made afterwards reflect
+// all the writes committed before Sync was called.
+func (conn *Conn) Sync(path string) (err error) {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return closingError("sync", path)
+	}
+	if err = conn.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { conn.breaker.record(err) }()
+
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	defer doneInFlight(conn.startInFlight())
+
+	data := C.create_completion_data()
+	if data == nil {
+		panic("Failed to create completion data")
+	}
+	defer C.destroy_completion_data(data)
+
+	rc, cerr := C.zoo_async(conn.handle, cpath, C.handle_string_completion, unsafe.Pointer(data))
+	if rc != C.ZOK {
+		return zkError(rc, cerr, "sync", path)
+	}
+
+	C.wait_for_completion(data)
+
+	rc = C.int(uintptr(data.data))
+	return zkError(rc, nil, "sync", path)
+}
+
+// GetWithChildren returns the data and status of the node at path,
+// along with the names of its children.  The two are read with
+// concurrent requests, which the C library pipelines over the same
+// connection, so it costs about a single round trip rather than two.
+// The reads are not atomic, though: the node may change between them,
+// in which case the children may not match the returned stat, which
+// comes from reading the data.
+func (conn *Conn) GetWithChildren(path string) (data string, children []string, stat *Stat, err error) {
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		children, _, err = conn.Children(path)
+		done <- err
+	}()
+	data, stat, err = conn.Get(path)
+	cerr := <-done
+	if err != nil {
+		return "", nil, nil, err
+	}
+	if cerr != nil {
+		return "", nil, nil, cerr
+	}
+	return data, children, stat, nil
+}
+
+// childrenDataConcurrency bounds how many children
+// ChildrenData reads at once.
+const childrenDataConcurrency = 16
+
+// ChildrenData returns the data of all the children of the node at
+// path, keyed by their names, along with the stat of the node itself.
+// The children are read concurrently once listed, and those deleted
+// in the meantime are left out.  As with GetWithChildren, the result
+// isn't atomic: children created after being listed are missing, and
+// the data of each of them is read at a different time.
+func (conn *Conn) ChildrenData(path string) (data map[string]string, stat *Stat, err error) {
+	children, stat, err := conn.Children(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	type result struct {
+		child, data string
+		err         error
+	}
+	results := make(chan result, len(children))
+	sem := make(chan bool, childrenDataConcurrency)
+	for _, child := range children {
+		sem <- true
+		go func(child string) {
+			defer func() { <-sem }()
+			data, _, err := conn.Get(strings.TrimSuffix(path, "/") + "/" + child)
+			results <- result{child, data, err}
+		}(child)
+	}
+	data = make(map[string]string, len(children))
+	for range children {
+		r := <-results
+		switch {
+		case r.err == nil:
+			data[r.child] = r.data
+		case IsError(r.err, ZNONODE):
+			// Deleted after being listed.
+		case err == nil:
+			err = r.err
+		}
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, stat, nil
+}
+
 // GetW works like Get but also returns a channel that will receive
 // a single Event value when the data or existence of the given ZooKeeper
 // node changes or when critical session events happen.  See the
 // documentation of the Event type for more details.
 func (conn *Conn) GetW(path string) (data string, stat *Stat, watch <-chan Event, err error) {
+	if conn.sharingWatches() {
+		watch, err = conn.sharedW("get", path, func(cb func(Event)) (err error) {
+			data, stat, _, _, err = conn.getWatch(path, cb, true)
+			return
+		}, func() (err error) {
+			data, stat, err = conn.Get(path)
+			return
+		})
+		return
+	}
+	data, stat, _, watch, err = conn.getW(path, nil)
+	return
+}
+
+// GetWithCallback works like GetW, but rather than returning a channel
+// it arranges for cb to be called with the single Event value that
+// would be delivered on it.  cb is run in a goroutine of its own, so
+// it may block without holding back the delivery of other events.
+func (conn *Conn) GetWithCallback(path string, cb func(Event)) (data string, stat *Stat, err error) {
+	data, stat, _, _, err = conn.getW(path, cb)
+	return
+}
+
+func (conn *Conn) getW(path string, cb func(Event)) (data string, stat *Stat, watchId uintptr, watch <-chan Event, err error) {
+	return conn.getWatch(path, cb, false)
+}
+
+// getWatch implements GetW and its variants.  The watch established
+// is not listed by DebugWatches if it's shared, since the subscribers
+// of the shared watch are listed instead.  The same goes for
+// childrenWatch and existsWatch.
+func (conn *Conn) getWatch(path string, cb func(Event), shared bool) (data string, stat *Stat, watchId uintptr, watch <-chan Event, err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
-		return "", nil, nil, closingError("getw", path)
+		return "", nil, 0, nil, closingError("getw", path)
+	}
+	if err = conn.breaker.allow(); err != nil {
+		return "", nil, 0, nil, err
 	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
-	cbuffer := (*C.char)(C.malloc(bufferSize))
+	bufferSize := getClientBufferSize()
+	cbuffer := (*C.char)(C.malloc(C.size_t(bufferSize)))
 	cbufferLen := C.int(bufferSize)
 	defer C.free(unsafe.Pointer(cpath))
 	defer C.free(unsafe.Pointer(cbuffer))
 
-	watchId, watchChannel := conn.createWatch(true)
+	watchId, watchChannel := conn.newWatch("get", path, cb, shared)
 
 	var cstat Stat
 	rc, cerr := C.zoo_wget_int(conn.handle, cpath, C.watch_handler, C.ulong(watchId), cbuffer, &cbufferLen, &cstat.c)
 	if rc != C.ZOK {
 		conn.forgetWatch(watchId)
-		return "", nil, nil, zkError(rc, cerr, "getw", path)
+		return "", nil, 0, nil, zkError(rc, cerr, "getw", path)
 	}
 
 	result := ""
 	if cbufferLen != -1 {
 		result = C.GoStringN(cbuffer, cbufferLen)
 	}
-	return result, &cstat, watchChannel, nil
+	return result, &cstat, watchId, watchChannel, nil
 }
 
 // Children returns the children list and status from an existing node.
 // Attempting to retrieve the children list from a non-existent node is an error.
+//
+// The server won't send a list larger than its jute.maxbuffer setting,
+// dropping the connection instead.  When listing an existing node fails
+// that way, the error returned keeps its ZCONNECTIONLOSS code but its
+// Detail says that the list is likely too large.
 func (conn *Conn) Children(path string) (children []string, stat *Stat, err error) {
+	var ch []string
+	var st *Stat
+	err = conn.withOpTimeout("children", path, func() (err error) {
+		ch, st, err = conn.children(path)
+		return err
+	})
+	if err != nil {
+		return nil, nil, conn.childrenError(path, err)
+	}
+	return ch, st, nil
+}
+
+// childrenError returns err, obtained when listing the children of
+// path, or an error explaining that the list likely exceeds the server
+// limit if the node exists with children and the server dropped the
+// connection or sent a response that couldn't be decoded.
+func (conn *Conn) childrenError(path string, err error) error {
+	zkErr, ok := err.(*Error)
+	if !ok || zkErr.Detail != "" || zkErr.Code != ZCONNECTIONLOSS && zkErr.Code != ZMARSHALLINGERROR {
+		return err
+	}
+	stat, serr := conn.Exists(path)
+	if serr != nil || stat == nil || stat.NumChildren() == 0 {
+		return err
+	}
+	detail := fmt.Sprintf("%d children likely exceed the server's jute.maxbuffer; raise it and list them with ChildrenIter", stat.NumChildren())
+	return &Error{Op: zkErr.Op, Code: zkErr.Code, Path: path, Detail: detail}
+}
+
+func (conn *Conn) children(path string) (children []string, stat *Stat, err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
 		return nil, nil, closingError("children", path)
 	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
@@ -623,17 +2182,60 @@ func (conn *Conn) Children(path string) (children []string, stat *Stat, err erro
 // receive a single Event value when a node is added or removed under the
 // provided path or when critical session events happen.  See the documentation
 // of the Event type for more details.
+//
+// As with Children, failing to list a node with too many children
+// is reported with an error saying so.
 func (conn *Conn) ChildrenW(path string) (children []string, stat *Stat, watch <-chan Event, err error) {
+	if conn.sharingWatches() {
+		watch, err = conn.sharedW("children", path, func(cb func(Event)) (err error) {
+			children, stat, _, err = conn.childrenWatch(path, cb, true)
+			return
+		}, func() (err error) {
+			children, stat, err = conn.Children(path)
+			return
+		})
+		if err != nil {
+			return nil, nil, nil, conn.childrenError(path, err)
+		}
+		return
+	}
+	children, stat, watch, err = conn.childrenW(path, nil)
+	if err != nil {
+		return nil, nil, nil, conn.childrenError(path, err)
+	}
+	return
+}
+
+// ChildrenWithCallback works like ChildrenW, but rather than returning
+// a channel it arranges for cb to be called with the single Event value
+// that would be delivered on it.  cb is run in a goroutine of its own.
+func (conn *Conn) ChildrenWithCallback(path string, cb func(Event)) (children []string, stat *Stat, err error) {
+	children, stat, _, err = conn.childrenW(path, cb)
+	if err != nil {
+		return nil, nil, conn.childrenError(path, err)
+	}
+	return
+}
+
+func (conn *Conn) childrenW(path string, cb func(Event)) (children []string, stat *Stat, watch <-chan Event, err error) {
+	return conn.childrenWatch(path, cb, false)
+}
+
+func (conn *Conn) childrenWatch(path string, cb func(Event), shared bool) (children []string, stat *Stat, watch <-chan Event, err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
 		return nil, nil, nil, closingError("childrenw", path)
 	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, nil, nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
-	watchId, watchChannel := conn.createWatch(true)
+	watchId, watchChannel := conn.newWatch("children", path, cb, shared)
 
 	cvector := C.struct_String_vector{}
 	defer C.deallocate_String_vector(&cvector)
@@ -657,25 +2259,175 @@ func (conn *Conn) ChildrenW(path string) (children []string, stat *Stat, watch <
 
 func parseStringVector(cvector *C.struct_String_vector) []string {
 	vector := make([]string, cvector.count)
-	dataStart := uintptr(unsafe.Pointer(cvector.data))
-	uintptrSize := unsafe.Sizeof(dataStart)
 	for i := 0; i != len(vector); i++ {
-		cpathPos := dataStart + uintptr(i)*uintptrSize
-		cpath := *(**C.char)(unsafe.Pointer(cpathPos))
-		vector[i] = C.GoString(cpath)
+		vector[i] = stringVectorAt(cvector, i)
 	}
 	return vector
 }
 
-// Exists checks if a node exists at the given path.  If it does,
-// stat will contain meta information on the existing node, otherwise
-// it will be nil.
-func (conn *Conn) Exists(path string) (stat *Stat, err error) {
-	conn.mutex.RLock()
-	defer conn.mutex.RUnlock()
-	if conn.handle == nil {
-		return nil, closingError("exists", path)
+// stringVectorAt returns the i-th string in cvector.
+func stringVectorAt(cvector *C.struct_String_vector, i int) string {
+	dataStart := uintptr(unsafe.Pointer(cvector.data))
+	uintptrSize := unsafe.Sizeof(dataStart)
+	cpathPos := dataStart + uintptr(i)*uintptrSize
+	cpath := *(**C.char)(unsafe.Pointer(cpathPos))
+	return C.GoString(cpath)
+}
+
+// ChildrenIter iterates over the children of a node, as returned by
+// Conn.ChildrenIter.  The names are kept in the memory allocated by the
+// C library, and only converted to Go strings one at a time, so that
+// nodes with a huge number of children may be processed with bounded
+// memory.  The memory is released once the iteration is over, or when
+// Close is called, which must be done if the iteration is abandoned
+// before Next returns false.
+//
+// A ChildrenIter is safe for concurrent use, although each value is
+// only observed by one of the callers of Next.
+type ChildrenIter struct {
+	mutex   sync.Mutex
+	path    string
+	cvector *C.struct_String_vector
+	stat    *Stat
+	next    int
+	value   string
+	err     error
+}
+
+// ChildrenIter works like Children, but returns an iterator over the
+// names of the children rather than a slice holding all of them.
+// The names are yielded in the order reported by the server, which is
+// unspecified, and the iterator must be closed after use unless it's
+// been exhausted.
+//
+//	iter, err := conn.ChildrenIter("/parent")
+//	if err != nil {
+//		return err
+//	}
+//	defer iter.Close()
+//	for iter.Next() {
+//		process(iter.Value())
+//	}
+//	return iter.Err()
+func (conn *Conn) ChildrenIter(path string) (iter *ChildrenIter, err error) {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return nil, closingError("children", path)
+	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
+
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	// The vector outlives this call, so it's allocated by C rather
+	// than by Go, and freed by ChildrenIter.Close.
+	cvector := (*C.struct_String_vector)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_String_vector{}))))
+
+	var cstat Stat
+	rc, cerr := C.zoo_wget_children2(conn.handle, cpath, nil, nil, cvector, &cstat.c)
+	if rc != C.ZOK {
+		C.deallocate_String_vector(cvector)
+		C.free(unsafe.Pointer(cvector))
+		return nil, zkError(rc, cerr, "children", path)
+	}
+	return &ChildrenIter{path: path, cvector: cvector, stat: &cstat}, nil
+}
+
+// Next advances the iterator to the next child, whose name is then
+// returned by Value.  It returns false once there are no more children,
+// or if the iterator was closed, releasing its memory.
+func (iter *ChildrenIter) Next() bool {
+	iter.mutex.Lock()
+	defer iter.mutex.Unlock()
+	if iter.cvector == nil {
+		iter.value = ""
+		return false
+	}
+	if iter.next >= int(iter.cvector.count) {
+		iter.value = ""
+		iter.closeLocked()
+		return false
+	}
+	iter.value = stringVectorAt(iter.cvector, iter.next)
+	iter.next++
+	return true
+}
+
+// Value returns the name of the child the iterator is at.
+func (iter *ChildrenIter) Value() string {
+	iter.mutex.Lock()
+	defer iter.mutex.Unlock()
+	return iter.value
+}
+
+// Err returns the error that interrupted the iteration, if any.
+// Iterating over the children obtained from the server can't fail,
+// but Err reports ZCLOSING when Next is stopped by a call to Close
+// before all the children were yielded.
+func (iter *ChildrenIter) Err() error {
+	iter.mutex.Lock()
+	defer iter.mutex.Unlock()
+	return iter.err
+}
+
+// Stat returns the status of the parent node, as of when
+// its children were read.
+func (iter *ChildrenIter) Stat() *Stat {
+	return iter.stat
+}
+
+// Close releases the memory held by the iterator.  It may be called
+// more than once, and after the iteration is over.
+func (iter *ChildrenIter) Close() error {
+	iter.mutex.Lock()
+	defer iter.mutex.Unlock()
+	if iter.cvector != nil && iter.next < int(iter.cvector.count) {
+		iter.err = closingError("children", iter.path)
+	}
+	iter.closeLocked()
+	return nil
+}
+
+// closeLocked frees the C vector exactly once.
+// It must be called with iter.mutex held.
+func (iter *ChildrenIter) closeLocked() {
+	if iter.cvector == nil {
+		return
+	}
+	C.deallocate_String_vector(iter.cvector)
+	C.free(unsafe.Pointer(iter.cvector))
+	iter.cvector = nil
+}
+
+// Exists checks if a node exists at the given path.  If it does,
+// stat will contain meta information on the existing node, otherwise
+// it will be nil.
+func (conn *Conn) Exists(path string) (stat *Stat, err error) {
+	var st *Stat
+	err = conn.withOpTimeout("exists", path, func() (err error) {
+		st, err = conn.exists(path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (conn *Conn) exists(path string) (stat *Stat, err error) {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return nil, closingError("exists", path)
 	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
@@ -694,22 +2446,70 @@ func (conn *Conn) Exists(path string) (stat *Stat, err error) {
 	return
 }
 
+// Ping performs a round trip to the server and returns how long it
+// took.  It issues a real read of the root node with Exists, so it
+// also reports errors such as a connection loss as they happen.
+func (conn *Conn) Ping() (time.Duration, error) {
+	start := time.Now()
+	if _, err := conn.Exists("/"); err != nil {
+		return 0, err
+	}
+	rtt := time.Since(start)
+	conn.pingMutex.Lock()
+	conn.pingRTTs = append(conn.pingRTTs, rtt)
+	if len(conn.pingRTTs) > qualityPings {
+		conn.pingRTTs = conn.pingRTTs[1:]
+	}
+	conn.pingMutex.Unlock()
+	return rtt, nil
+}
+
 // ExistsW works like Exists but also returns a channel that will
 // receive an Event value when a node is created in case the returned
 // stat is nil and the node didn't exist, or when the existing node
 // is removed. It will also receive critical session events. See the
 // documentation of the Event type for more details.
 func (conn *Conn) ExistsW(path string) (stat *Stat, watch <-chan Event, err error) {
+	if conn.sharingWatches() {
+		watch, err = conn.sharedW("exists", path, func(cb func(Event)) (err error) {
+			stat, _, err = conn.existsWatch(path, cb, true)
+			return
+		}, func() (err error) {
+			stat, err = conn.Exists(path)
+			return
+		})
+		return
+	}
+	return conn.existsW(path, nil)
+}
+
+// ExistsWithCallback works like ExistsW, but rather than returning
+// a channel it arranges for cb to be called with the single Event value
+// that would be delivered on it.  cb is run in a goroutine of its own.
+func (conn *Conn) ExistsWithCallback(path string, cb func(Event)) (stat *Stat, err error) {
+	stat, _, err = conn.existsW(path, cb)
+	return
+}
+
+func (conn *Conn) existsW(path string, cb func(Event)) (stat *Stat, watch <-chan Event, err error) {
+	return conn.existsWatch(path, cb, false)
+}
+
+func (conn *Conn) existsWatch(path string, cb func(Event), shared bool) (stat *Stat, watch <-chan Event, err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
 		return nil, nil, closingError("existsw", path)
 	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
 
-	watchId, watchChannel := conn.createWatch(true)
+	watchId, watchChannel := conn.newWatch("exists", path, cb, shared)
 
 	var cstat Stat
 	rc, cerr := C.zoo_wexists_int(conn.handle, cpath, C.watch_handler, C.ulong(watchId), &cstat.c)
@@ -730,21 +2530,151 @@ func (conn *Conn) ExistsW(path string) (stat *Stat, watch <-chan Event, err erro
 	return
 }
 
+// ExistsWMany works like calling ExistsW for each of the given paths,
+// but issues all of the requests before waiting for any of them to
+// complete, which makes installing watches on many nodes much faster.
+// The returned slices are aligned with paths: for each of them they
+// hold the stat, which is nil if the node doesn't exist, the watch
+// channel, which behaves as the one returned by ExistsW, and the error,
+// in which case there is no watch.  The number of outstanding requests
+// is bounded by the limit set with SetMaxInFlight, if any.
+func (conn *Conn) ExistsWMany(paths []string) (stats []*Stat, watches []<-chan Event, errs []error) {
+	stats = make([]*Stat, len(paths))
+	watches = make([]<-chan Event, len(paths))
+	errs = make([]error, len(paths))
+	if conn.sharingWatches() {
+		// Shared watches are subscribed to one at a time.
+		for i, path := range paths {
+			stats[i], watches[i], errs[i] = conn.ExistsW(path)
+		}
+		return
+	}
+
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		for i, path := range paths {
+			errs[i] = closingError("existsw", path)
+		}
+		return
+	}
+	if err := conn.breaker.allow(); err != nil {
+		for i := range paths {
+			errs[i] = err
+		}
+		return
+	}
+
+	batch := asyncBatch{conn: conn}
+	for i, path := range paths {
+		i, path := i, path
+		data, inFlight := batch.start()
+		watchId, watchChannel := conn.newWatch("exists", path, nil, false)
+		cpath := C.CString(path)
+		// The request is serialized right away, and the watch is
+		// registered with a copy of the path, so it may be freed
+		// before the request completes.
+		rc, cerr := C.zoo_awexists_int(conn.handle, cpath, C.watch_handler, C.ulong(watchId), C.handle_stat_completion, unsafe.Pointer(data))
+		C.free(unsafe.Pointer(cpath))
+		batch.issued(rc, cerr, data, inFlight, func(rc C.int, cerr error, data *C.completion_data) {
+			// As with ExistsW, a missing node still gets a watch.
+			switch ErrorCode(rc) {
+			case ZOK:
+				stats[i] = &Stat{c: data.stat}
+				watches[i] = watchChannel
+			case ZNONODE:
+				watches[i] = watchChannel
+			default:
+				conn.forgetWatch(watchId)
+				errs[i] = zkError(rc, cerr, "existsw", path)
+			}
+			conn.breaker.record(errs[i])
+		})
+	}
+	batch.wait()
+	return
+}
+
+// SetDefaultACL sets the access control list used by Create when it
+// is called with a nil ACL.  If never set, WorldACL(PERM_ALL) is used.
+// An explicit non-nil ACL passed to Create always overrides the default,
+// and passing a nil aclv to SetDefaultACL restores the original default.
+func (conn *Conn) SetDefaultACL(aclv []ACL) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if aclv == nil {
+		conn.defaultACL = nil
+	} else {
+		conn.defaultACL = append(make([]ACL, 0, len(aclv)), aclv...)
+	}
+}
+
+// aclOrDefault returns aclv, or the default ACL for conn if aclv
+// is nil.  It must be called with conn.mutex held.
+func (conn *Conn) aclOrDefault(aclv []ACL) []ACL {
+	if aclv != nil {
+		return aclv
+	}
+	if conn.defaultACL != nil {
+		return conn.defaultACL
+	}
+	return WorldACL(PERM_ALL)
+}
+
 // Create creates a node at the given path with the given data. The
 // provided flags may determine features such as whether the node is
 // ephemeral or not, or whether it should have a sequence number
 // attached to it, and the provided ACLs will determine who can access
-// the node and under which circumstances.
+// the node and under which circumstances.  If aclv is nil, the ACL set
+// with SetDefaultACL is used instead.
 //
 // The returned path is useful in cases where the created path may differ
 // from the requested one, such as when a sequence number is appended
 // to it due to the use of the gozk.SEQUENCE flag.
 func (conn *Conn) Create(path, value string, flags int, aclv []ACL) (pathCreated string, err error) {
+	return conn.create("create", path, value, flags, aclv, 0)
+}
+
+// CreateTTL works like Create, but creates a persistent node that is
+// deleted by the server once it has had no children for longer than
+// ttl, and wasn't modified within that time either.  The TTL flag must
+// be provided, and it may only be combined with SEQUENCE.  TTL nodes
+// must be enabled in the server with the extendedTypesEnabled system
+// property, and require a C library supporting them (see FEATURE_TTL).
+func (conn *Conn) CreateTTL(path, value string, flags int, aclv []ACL, ttl time.Duration) (pathCreated string, err error) {
+	return conn.create("createttl", path, value, flags, aclv, ttl)
+}
+
+func (conn *Conn) create(op, path, value string, flags int, aclv []ACL, ttl time.Duration) (pathCreated string, err error) {
+	var created string
+	err = conn.withOpTimeout(op, path, func() (err error) {
+		created, err = conn.createNode(op, path, value, flags, aclv, ttl)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return created, nil
+}
+
+func (conn *Conn) createNode(op, path, value string, flags int, aclv []ACL, ttl time.Duration) (pathCreated string, err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
-		return "", closingError("close", path)
+		return "", closingError(op, path)
+	}
+	mode, err := createMode(flags, ttl, op, path)
+	if err != nil {
+		return "", err
 	}
+	aclv = conn.aclOrDefault(aclv)
+	if err := validateACL(aclv, op, path); err != nil {
+		return "", err
+	}
+	if err = conn.breaker.allow(); err != nil {
+		return "", err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	cvalue := C.CString(value)
@@ -759,15 +2689,181 @@ func (conn *Conn) Create(path, value string, flags int, aclv []ACL) (pathCreated
 	cpathCreated := (*C.char)(C.malloc(cpathLen))
 	defer C.free(unsafe.Pointer(cpathCreated))
 
-	rc, cerr := C.zoo_create(conn.handle, cpath, cvalue, C.int(len(value)), caclv, C.int(flags), cpathCreated, C.int(cpathLen))
+	var rc C.int
+	var cerr error
+	if ttl != 0 {
+		rc, cerr = C.zoo_create2_ttl_weak(conn.handle, cpath, cvalue, C.int(len(value)), caclv, C.int(mode), C.int64_t(ttl/time.Millisecond), cpathCreated, C.int(cpathLen), nil)
+	} else {
+		rc, cerr = C.zoo_create(conn.handle, cpath, cvalue, C.int(len(value)), caclv, C.int(mode), cpathCreated, C.int(cpathLen))
+	}
 	if rc == C.ZOK {
 		pathCreated = C.GoString(cpathCreated)
 	} else {
-		err = zkError(rc, cerr, "create", path)
+		err = zkError(rc, cerr, op, path)
 	}
 	return
 }
 
+// CreateT works like Create, but uses the ACL template registered
+// with RegisterACL under the given name for the new node.
+func (conn *Conn) CreateT(path, value string, flags int, aclName string) (pathCreated string, err error) {
+	aclv, err := lookupACL(aclName, "create", path)
+	if err != nil {
+		return "", err
+	}
+	return conn.Create(path, value, flags, aclv)
+}
+
+// CreateChecked works like Create, but when the creation fails with
+// ZNONODE it checks whether that's because the parent of the node is
+// missing, and if so it says so in the Detail of the returned *Error,
+// which still has the ZNONODE code.  The check costs an additional
+// round trip to the server, which is only made when Create fails.
+func (conn *Conn) CreateChecked(path, value string, flags int, aclv []ACL) (pathCreated string, err error) {
+	pathCreated, err = conn.Create(path, value, flags, aclv)
+	if !IsError(err, ZNONODE) {
+		return pathCreated, err
+	}
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "", err
+	}
+	parent := path[:i]
+	if stat, serr := conn.Exists(parent); serr == nil && stat == nil {
+		err.(*Error).Detail = fmt.Sprintf("parent %q does not exist", parent)
+	}
+	return "", err
+}
+
+// CreateRecursive works like Create, but first creates any missing
+// ancestors of path as empty persistent nodes with the given ACL.
+// Ancestors created concurrently by someone else are left alone.
+func (conn *Conn) CreateRecursive(path, value string, flags int, aclv []ACL) (pathCreated string, err error) {
+	return conn.CreateRecursiveFunc(path, value, flags, func(string) []ACL { return aclv })
+}
+
+// CreateRecursiveFunc works like CreateRecursive, but the ACL of each
+// node created, including the final one, is obtained by calling aclFor
+// with the path of that node.  This allows permission boundaries to
+// sit at intermediate levels, as with a world readable namespace holding
+// nodes protected with digest credentials.  With the SEQUENCE flag,
+// aclFor is called with path itself for the final node, before the
+// sequence number is appended.
+//
+// The node is created right away when its parent exists.  Otherwise
+// ancestors are checked for existence before being created, from the
+// deepest one up, so that existing ones are left alone even when their
+// own parents don't allow the caller to create nodes, and aclFor is
+// only called for the nodes actually created.
+func (conn *Conn) CreateRecursiveFunc(path, value string, flags int, aclFor func(path string) []ACL) (pathCreated string, err error) {
+	aclv := aclFor(path)
+	pathCreated, err = conn.Create(path, value, flags, aclv)
+	if !IsError(err, ZNONODE) {
+		return pathCreated, err
+	}
+	// Find the deepest existing ancestor, at path[:start].
+	start := len(path)
+	for {
+		start = strings.LastIndex(path[:start], "/")
+		if start <= 0 {
+			start = 0
+			break
+		}
+		stat, err := conn.Exists(path[:start])
+		if err != nil {
+			return "", err
+		}
+		if stat != nil {
+			break
+		}
+	}
+	for i := start + 1; i < len(path); i++ {
+		if path[i] != '/' {
+			continue
+		}
+		ancestor := path[:i]
+		_, err := conn.Create(ancestor, "", 0, aclFor(ancestor))
+		if err != nil && !IsError(err, ZNODEEXISTS) {
+			return "", err
+		}
+	}
+	return conn.Create(path, value, flags, aclv)
+}
+
+// sequenceDigits is the width of the sequence numbers that
+// ZooKeeper appends to the names of sequential nodes.
+const sequenceDigits = 10
+
+// FormatSequence formats n as ZooKeeper does when appending it to the
+// name of a sequential node: zero-padded to 10 digits.  The counter the
+// numbers come from is a signed 32-bit one, so numbers past its wrap
+// are negative, and padded to 10 characters including the sign.
+func FormatSequence(n int64) string {
+	return fmt.Sprintf("%0*d", sequenceDigits, n)
+}
+
+// ParseSequence splits the name of a sequential node into the prefix
+// requested when creating it and the sequence number appended by
+// ZooKeeper.  Negative numbers taking 11 characters, as the lowest ones
+// do, are only recognized as such below -2147483647, since the digits
+// of higher ones could equally be a positive number following a prefix
+// that ends in a dash.
+func ParseSequence(name string) (prefix string, n int64, err error) {
+	if len(name) < sequenceDigits {
+		return "", 0, fmt.Errorf("zookeeper: no sequence number in %q", name)
+	}
+	i := len(name) - sequenceDigits
+	suffix := name[i:]
+	negative := suffix[0] == '-'
+	if negative {
+		suffix = suffix[1:]
+	}
+	for _, r := range suffix {
+		if r < '0' || r > '9' {
+			return "", 0, fmt.Errorf("zookeeper: no sequence number in %q", name)
+		}
+	}
+	n, err = strconv.ParseInt(suffix, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("zookeeper: no sequence number in %q", name)
+	}
+	if !negative && n > math.MaxInt32 && i > 0 && name[i-1] == '-' {
+		negative = true
+		i--
+	}
+	if negative {
+		n = -n
+	}
+	return name[:i], n, nil
+}
+
+// sequencePrefix is the name of the nodes created by NextSequence,
+// before the sequence number is appended.
+const sequencePrefix = "seq-"
+
+// NextSequence returns the next value of the counter kept by the
+// directory node at path, creating it and any missing ancestors with
+// an open ACL if needed.  The value is obtained by creating a
+// sequential node under path, which is deleted right away.
+//
+// Values returned for the same path are unique and increasing across
+// all clients, but not contiguous: the counter is the one ZooKeeper
+// keeps for the children of path, so creating other children there
+// also consumes values.  If the node can't be deleted, the value is
+// still returned along with the error, as it was consumed anyway.
+func (conn *Conn) NextSequence(path string) (int64, error) {
+	prefix := strings.TrimSuffix(path, "/") + "/" + sequencePrefix
+	node, err := conn.CreateRecursive(prefix, "", SEQUENCE, WorldACL(PERM_ALL))
+	if err != nil {
+		return 0, err
+	}
+	nodePrefix, n, err := ParseSequence(node)
+	if err != nil || nodePrefix != prefix {
+		return 0, fmt.Errorf("zookeeper: unexpected sequential node name %q", node)
+	}
+	return n, conn.Delete(node, -1)
+}
+
 // Set modifies the data for the existing node at the given path, replacing it
 // by the provided value. If version is not -1, the operation will only
 // succeed if the node is still at the given version when the replacement
@@ -777,11 +2873,27 @@ func (conn *Conn) Create(path, value string, flags int, aclv []ACL) (pathCreated
 // It is an error to attempt to set the data of a non-existing node with
 // this function. In these cases, use Create instead.
 func (conn *Conn) Set(path, value string, version int) (stat *Stat, err error) {
+	var st *Stat
+	err = conn.withOpTimeout("set", path, func() (err error) {
+		st, err = conn.set(path, value, version)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (conn *Conn) set(path, value string, version int) (stat *Stat, err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
 		return nil, closingError("set", path)
 	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	cvalue := C.CString(value)
@@ -798,15 +2910,81 @@ func (conn *Conn) Set(path, value string, version int) (stat *Stat, err error) {
 	return
 }
 
+// SetItem describes a change made by SetMany: the data of the node at
+// Path is replaced by Value, if the node is at the given Version, or
+// unconditionally if Version is -1.
+type SetItem struct {
+	Path    string
+	Value   string
+	Version int
+}
+
+// SetMany changes the data of several nodes, as Set does for each of
+// the items.  The changes are sent to the server all at once, rather
+// than waiting for each to complete before sending the next one, which
+// makes it much faster than calling Set repeatedly.  The returned slice
+// holds the error for each item, which is nil if the change succeeded.
+//
+// The changes are independent of each other: some may succeed while
+// others fail.  Use a Transaction instead when they must be applied
+// atomically.  The number of outstanding changes is bounded by the
+// limit set with SetMaxInFlight, if any.
+func (conn *Conn) SetMany(items []SetItem) []error {
+	errs := make([]error, len(items))
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		for i, item := range items {
+			errs[i] = closingError("set", item.Path)
+		}
+		return errs
+	}
+	if err := conn.breaker.allow(); err != nil {
+		for i := range items {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	batch := asyncBatch{conn: conn}
+	for i, item := range items {
+		i, item := i, item
+		data, inFlight := batch.start()
+		cpath := C.CString(item.Path)
+		cvalue := C.CString(item.Value)
+		// The request is serialized right away, so the
+		// strings may be freed before it completes.
+		rc, cerr := C.zoo_aset(conn.handle, cpath, cvalue, C.int(len(item.Value)), C.int(item.Version), C.handle_stat_completion, unsafe.Pointer(data))
+		C.free(unsafe.Pointer(cpath))
+		C.free(unsafe.Pointer(cvalue))
+		batch.issued(rc, cerr, data, inFlight, func(rc C.int, cerr error, data *C.completion_data) {
+			errs[i] = zkError(rc, cerr, "set", item.Path)
+			conn.breaker.record(errs[i])
+		})
+	}
+	batch.wait()
+	return errs
+}
+
 // Delete removes the node at path. If version is not -1, the operation
 // will only succeed if the node is still at this version when the
 // node is deleted as an atomic operation.
 func (conn *Conn) Delete(path string, version int) (err error) {
+	return conn.withOpTimeout("delete", path, func() error {
+		return conn.delete(path, version)
+	})
+}
+
+func (conn *Conn) delete(path string, version int) (err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
 		return closingError("delete", path)
 	}
+	if err = conn.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
@@ -814,23 +2992,79 @@ func (conn *Conn) Delete(path string, version int) (err error) {
 	return zkError(rc, cerr, "delete", path)
 }
 
+// DeleteChecked works like Delete, but when the deletion fails with
+// ZNOTEMPTY it lists the children of the node and mentions them in the
+// Detail of the returned *Error, which still has the ZNOTEMPTY code.
+// Listing the children is best effort: if they vanish or the listing
+// fails, the error is returned without them.
+func (conn *Conn) DeleteChecked(path string, version int) error {
+	err := conn.Delete(path, version)
+	if !IsError(err, ZNOTEMPTY) {
+		return err
+	}
+	children, _, cerr := conn.Children(path)
+	if cerr == nil && len(children) > 0 {
+		sort.Strings(children)
+		err.(*Error).Detail = fmt.Sprintf("has %d children: %v", len(children), children)
+	}
+	return err
+}
+
+// DeleteIfExists works like Delete, but a node that doesn't exist,
+// as when someone else deleted it first, is not an error.  deleted
+// reports whether the node was deleted by this call.
+func (conn *Conn) DeleteIfExists(path string, version int) (deleted bool, err error) {
+	err = conn.Delete(path, version)
+	if IsError(err, ZNONODE) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// CompareAndDelete deletes the node at path only if its data is
+// expected, which is useful for cleaning up a node that is believed to
+// be owned by the caller.  The node is read first, and deleted at the
+// version read, so it's not deleted if it changed in the meantime.
+// deleted reports whether the node was deleted by this call.  A node
+// that doesn't exist, or whose data doesn't match, is not an error.
+func (conn *Conn) CompareAndDelete(path, expected string) (deleted bool, err error) {
+	data, stat, err := conn.Get(path)
+	if IsError(err, ZNONODE) {
+		return false, nil
+	}
+	if err != nil || data != expected {
+		return false, err
+	}
+	err = conn.Delete(path, stat.Version())
+	if IsError(err, ZNONODE) || IsError(err, ZBADVERSION) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
 // AddAuth adds a new authentication certificate to the ZooKeeper
 // interaction. The scheme parameter will specify how to handle the
 // authentication information, while the cert parameter provides the
 // identity data itself. For instance, the "digest" scheme requires
 // a pair like "username:password" to be provided as the certificate.
-func (conn *Conn) AddAuth(scheme, cert string) error {
+func (conn *Conn) AddAuth(scheme, cert string) (err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
 		return closingError("addauth", "")
 	}
+	if err = conn.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cscheme := C.CString(scheme)
 	ccert := C.CString(cert)
 	defer C.free(unsafe.Pointer(cscheme))
 	defer C.free(unsafe.Pointer(ccert))
 
+	defer doneInFlight(conn.startInFlight())
+
 	data := C.create_completion_data()
 	if data == nil {
 		panic("Failed to create completion data")
@@ -845,16 +3079,85 @@ func (conn *Conn) AddAuth(scheme, cert string) error {
 	C.wait_for_completion(data)
 
 	rc = C.int(uintptr(data.data))
+	if rc == C.ZOK {
+		conn.authsMutex.Lock()
+		conn.auths = append(conn.auths, authInfo{scheme, cert})
+		conn.authsMutex.Unlock()
+	}
 	return zkError(rc, nil, "addauth", "")
 }
 
-// ACL returns the access control list for path.
-func (conn *Conn) ACL(path string) ([]ACL, *Stat, error) {
+// CanWrite returns whether the ACL of the node at path grants write
+// permission to conn, considering the credentials added with AddAuth.
+// This is a best-effort prediction made on the client side, useful to
+// fail early with a good message: the server remains the authority,
+// and ACL entries with the "ip" scheme, or with schemes whose ids don't
+// match the added credential verbatim, are not considered as granting
+// permission.
+func (conn *Conn) CanWrite(path string) (bool, error) {
+	aclv, _, err := conn.ACL(path)
+	if err != nil {
+		return false, err
+	}
+	conn.authsMutex.Lock()
+	defer conn.authsMutex.Unlock()
+	for _, acl := range aclv {
+		if acl.Perms&PERM_WRITE == 0 {
+			continue
+		}
+		switch acl.Scheme {
+		case "world":
+			if acl.Id == "anyone" {
+				return true, nil
+			}
+		case "auth":
+			if len(conn.auths) > 0 {
+				return true, nil
+			}
+		case "ip":
+			// The client address as seen by the server is unknown.
+		default:
+			for _, auth := range conn.auths {
+				if auth.scheme != acl.Scheme {
+					continue
+				}
+				id := auth.cert
+				if auth.scheme == "digest" {
+					id = digestId(auth.cert)
+				}
+				if id == acl.Id {
+					return true, nil
+				}
+			}
+		}
+	}
+	return false, nil
+}
+
+// digestId returns the id used in "digest" ACLs for the
+// given "user:password" certificate.
+func digestId(cert string) string {
+	user := cert
+	if i := strings.Index(cert, ":"); i >= 0 {
+		user = cert[:i]
+	}
+	sum := sha1.Sum([]byte(cert))
+	return user + ":" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ACL returns the access control list for path.  The entries are not
+// necessarily in the order they were set; use NormalizeACL or ACLEqual
+// when comparing them with a known list.
+func (conn *Conn) ACL(path string) (aclv []ACL, stat *Stat, err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
 		return nil, nil, closingError("acl", path)
 	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
@@ -867,18 +3170,23 @@ func (conn *Conn) ACL(path string) ([]ACL, *Stat, error) {
 		return nil, nil, zkError(rc, cerr, "acl", path)
 	}
 
-	aclv := parseACLVector(&caclv)
-
-	return aclv, &cstat, nil
+	return parseACLVector(&caclv), &cstat, nil
 }
 
 // SetACL changes the access control list for path.
-func (conn *Conn) SetACL(path string, aclv []ACL, version int) error {
+func (conn *Conn) SetACL(path string, aclv []ACL, version int) (err error) {
 	conn.mutex.RLock()
 	defer conn.mutex.RUnlock()
 	if conn.handle == nil {
 		return closingError("setacl", path)
 	}
+	if err := validateACL(aclv, "setacl", path); err != nil {
+		return err
+	}
+	if err = conn.breaker.allow(); err != nil {
+		return err
+	}
+	defer func() { conn.breaker.record(err) }()
 
 	cpath := C.CString(path)
 	defer C.free(unsafe.Pointer(cpath))
@@ -941,79 +3249,2189 @@ func LoadClientId(b []byte) (*ClientId, error) {
 		return nil, errors.New("client id size mismatch")
 	}
 
-	c.cId.client_id = C.int64_t(binary.BigEndian.Uint64(b))
-	for i := uintptr(0); i < unsafe.Sizeof(c.cId.passwd); i++ {
-		c.cId.passwd[i] = C.char(b[offsetClientIdPasswd+i])
+	c.cId.client_id = C.int64_t(binary.BigEndian.Uint64(b))
+	for i := uintptr(0); i < unsafe.Sizeof(c.cId.passwd); i++ {
+		c.cId.passwd[i] = C.char(b[offsetClientIdPasswd+i])
+	}
+	return c, nil
+}
+
+// SessionId returns the id of the session, as found in the
+// EphemeralOwner of nodes created by the session.
+func (c *ClientId) SessionId() int64 {
+	return int64(c.cId.client_id)
+}
+
+func (c *ClientId) Save() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := binary.Write(buf, binary.BigEndian, c.cId)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// -----------------------------------------------------------------------
+// Circuit breaker.
+
+// ErrCircuitOpen is the error returned by operations on a connection
+// whose circuit breaker is open.  See SetCircuitBreaker.
+var ErrCircuitOpen = errors.New("zookeeper: circuit open")
+
+// IsRecoverable returns whether err is a transient failure, after which
+// the same operation may be retried on the same connection once it's
+// working again: ZCONNECTIONLOSS, ZOPERATIONTIMEOUT or ErrCircuitOpen.
+// Other errors either report a problem with the operation itself, or
+// require the connection to be established anew, as with an expired
+// session.
+func IsRecoverable(err error) bool {
+	return err == ErrCircuitOpen || IsError(err, ZCONNECTIONLOSS) || IsError(err, ZOPERATIONTIMEOUT)
+}
+
+// circuitBreaker counts consecutive connection failures of the
+// operations on a connection, and tells whether operations may be
+// attempted at all.
+type circuitBreaker struct {
+	mutex       sync.Mutex
+	maxFailures int
+	cooldown    time.Duration
+	failures    int
+
+	// openUntil is the time the breaker opened until, or zero if
+	// it's closed.  Once that time is past, probing is set while
+	// a single operation is let through to probe the connection.
+	openUntil time.Time
+	probing   bool
+
+	// lastErr is the last error recorded, which is tracked for
+	// Conn.Health even when the breaker is disabled, and lastReply
+	// is when an operation last got a reply from the server, which
+	// is tracked for Conn.SessionTimeRemaining.
+	lastErr   error
+	lastReply time.Time
+}
+
+// SetCircuitBreaker enables a circuit breaker on conn, which opens after
+// maxFailures consecutive operations fail with ZCONNECTIONLOSS or
+// ZOPERATIONTIMEOUT.  While the breaker is open, operations that would
+// make a round trip to the server fail right away with ErrCircuitOpen,
+// rather than piling up on a connection that isn't working.  Once the
+// cooldown is over, a single operation is let through as a probe: if it
+// reaches the server, the breaker closes again, and otherwise it stays
+// open for another cooldown.  Any operation that reaches the server,
+// even if it fails for some other reason, resets the count of failures.
+// A maxFailures of zero disables the breaker, which is the default.
+func (conn *Conn) SetCircuitBreaker(maxFailures int, cooldown time.Duration) {
+	b := &conn.breaker
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.maxFailures = maxFailures
+	b.cooldown = cooldown
+	b.failures = 0
+	b.openUntil = time.Time{}
+	b.probing = false
+}
+
+// allow returns ErrCircuitOpen if an operation may not be attempted.
+// Otherwise the result of the operation must be given to record.
+func (b *circuitBreaker) allow() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.maxFailures == 0 || b.openUntil.IsZero() {
+		return nil
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return ErrCircuitOpen
+	}
+	b.probing = true
+	return nil
+}
+
+// record updates the breaker with the result of an operation.
+func (b *circuitBreaker) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err != nil {
+		b.lastErr = err
+	}
+	if e, ok := err.(*Error); err == nil || ok && e.Code <= ZAPIERROR && e.Code != ZCLOSING {
+		b.lastReply = time.Now()
+	}
+	if b.maxFailures == 0 {
+		return
+	}
+	if err == ErrCircuitOpen || IsError(err, ZCLOSING) {
+		// Failed without trying.
+		return
+	}
+	if !IsRecoverable(err) {
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.probing = false
+		return
+	}
+	b.failures++
+	if b.probing || b.failures >= b.maxFailures {
+		b.openUntil = time.Now().Add(b.cooldown)
+		b.probing = false
+	}
+}
+
+// lastError returns the last error recorded.
+func (b *circuitBreaker) lastError() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.lastErr
+}
+
+// -----------------------------------------------------------------------
+// Transactions.
+
+// Transaction accumulates operations to be committed atomically to
+// ZooKeeper: either all of them succeed, or none of them is applied.
+// Transactions require a C library with FEATURE_MULTI support.
+type Transaction struct {
+	conn *Conn
+	ops  []transactionOp
+}
+
+// Constants for TransactionResult Op.
+const (
+	OP_CREATE = iota + 1
+	OP_DELETE
+	OP_SET
+	OP_CHECK
+)
+
+type transactionOp struct {
+	op      int
+	path    string
+	value   string
+	flags   int
+	version int
+	aclv    []ACL
+}
+
+// TransactionResult holds the outcome of one of the operations
+// in a committed transaction.
+type TransactionResult struct {
+	Op          int    // One of the OP_* constants.
+	Path        string // The path the operation was requested on.
+	PathCreated string // For OP_CREATE, the path of the node created.
+	Stat        *Stat  // For OP_SET, the resulting node status.
+	Err         error  // The error for this operation, if any.
+}
+
+// NewTransaction returns a new empty transaction for conn.  Operations
+// are added to it with the Create, Delete, Set and Check methods, which
+// may be chained, and are only sent to ZooKeeper once Commit is called.
+func (conn *Conn) NewTransaction() *Transaction {
+	return &Transaction{conn: conn}
+}
+
+// Create adds to tx an operation that works like Conn.Create.
+func (tx *Transaction) Create(path, value string, flags int, aclv []ACL) *Transaction {
+	tx.ops = append(tx.ops, transactionOp{op: OP_CREATE, path: path, value: value, flags: flags, aclv: aclv})
+	return tx
+}
+
+// Delete adds to tx an operation that works like Conn.Delete.
+func (tx *Transaction) Delete(path string, version int) *Transaction {
+	tx.ops = append(tx.ops, transactionOp{op: OP_DELETE, path: path, version: version})
+	return tx
+}
+
+// Set adds to tx an operation that works like Conn.Set.
+func (tx *Transaction) Set(path, value string, version int) *Transaction {
+	tx.ops = append(tx.ops, transactionOp{op: OP_SET, path: path, value: value, version: version})
+	return tx
+}
+
+// Check adds to tx an operation that changes nothing, but causes the
+// whole transaction to fail unless the node at path is at the given
+// version, or exists at all if version is -1.
+func (tx *Transaction) Check(path string, version int) *Transaction {
+	tx.ops = append(tx.ops, transactionOp{op: OP_CHECK, path: path, version: version})
+	return tx
+}
+
+// Commit sends all the operations in tx to ZooKeeper as a single
+// atomic transaction.  The returned results hold one entry for each
+// operation, in the order they were added.  If the transaction fails,
+// the returned error reports the first failing operation, and the Err
+// field of each result reports why the respective operation failed or
+// was not applied.
+func (tx *Transaction) Commit() (results []TransactionResult, err error) {
+	conn := tx.conn
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return nil, closingError("multi", "")
+	}
+	if len(tx.ops) == 0 {
+		return nil, nil
+	}
+	if !Supported(FEATURE_MULTI) {
+		return nil, zkError(C.int(ZUNIMPLEMENTED), nil, "multi", "")
+	}
+	for _, op := range tx.ops {
+		if op.op != OP_CREATE {
+			continue
+		}
+		if err := validateACL(conn.aclOrDefault(op.aclv), "multi", op.path); err != nil {
+			return nil, err
+		}
+	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
+
+	count := len(tx.ops)
+	opSize := unsafe.Sizeof(C.zoo_op_t{})
+	resultSize := unsafe.Sizeof(C.zoo_op_result_t{})
+	cops := C.calloc(C.size_t(count), C.size_t(opSize))
+	cresults := C.calloc(C.size_t(count), C.size_t(resultSize))
+	if cops == nil || cresults == nil {
+		panic("Multi op allocation failed")
+	}
+	defer C.free(cops)
+	defer C.free(cresults)
+
+	// All memory referenced by the C ops must be allocated in C.
+	var cfree []unsafe.Pointer
+	defer func() {
+		for _, p := range cfree {
+			C.free(p)
+		}
+	}()
+	cstring := func(s string) *C.char {
+		cs := C.CString(s)
+		cfree = append(cfree, unsafe.Pointer(cs))
+		return cs
+	}
+
+	cpathsCreated := make([]*C.char, count)
+	cstats := make([]*C.struct_Stat, count)
+	for i, op := range tx.ops {
+		cop := (*C.zoo_op_t)(unsafe.Pointer(uintptr(cops) + uintptr(i)*opSize))
+		cpath := cstring(op.path)
+		switch op.op {
+		case OP_CREATE:
+			caclv := (*C.struct_ACL_vector)(C.malloc(C.size_t(unsafe.Sizeof(C.struct_ACL_vector{}))))
+			*caclv = *buildACLVector(conn.aclOrDefault(op.aclv))
+			defer C.deallocate_ACL_vector(caclv)
+			cfree = append(cfree, unsafe.Pointer(caclv))
+
+			// Allocate additional space for the sequence.
+			cpathLen := C.size_t(len(op.path) + 32)
+			cpathsCreated[i] = (*C.char)(C.malloc(cpathLen))
+			cfree = append(cfree, unsafe.Pointer(cpathsCreated[i]))
+
+			C.init_create_op(cop, cpath, cstring(op.value), C.int(len(op.value)), caclv, C.int(op.flags), cpathsCreated[i], C.int(cpathLen))
+		case OP_DELETE:
+			C.init_delete_op(cop, cpath, C.int(op.version))
+		case OP_SET:
+			cstats[i] = (*C.struct_Stat)(C.calloc(1, C.size_t(unsafe.Sizeof(C.struct_Stat{}))))
+			cfree = append(cfree, unsafe.Pointer(cstats[i]))
+			C.init_set_op(cop, cpath, cstring(op.value), C.int(len(op.value)), C.int(op.version), cstats[i])
+		case OP_CHECK:
+			C.init_check_op(cop, cpath, C.int(op.version))
+		}
+	}
+
+	rc, cerr := C.zoo_multi_weak(conn.handle, C.int(count), (*C.zoo_op_t)(cops), (*C.zoo_op_result_t)(cresults))
+
+	results = make([]TransactionResult, count)
+	for i, op := range tx.ops {
+		cresult := (*C.zoo_op_result_t)(unsafe.Pointer(uintptr(cresults) + uintptr(i)*resultSize))
+		result := &results[i]
+		result.Op = op.op
+		result.Path = op.path
+		if rc == C.ZOK {
+			switch op.op {
+			case OP_CREATE:
+				result.PathCreated = C.GoString(cpathsCreated[i])
+			case OP_SET:
+				result.Stat = &Stat{*cstats[i]}
+			}
+			continue
+		}
+		result.Err = zkError(cresult.err, nil, "multi", op.path)
+		if result.Err != nil && err == nil && ErrorCode(cresult.err) != ZRUNTIMEINCONSISTENCY {
+			err = zkError(cresult.err, nil, "multi", op.path)
+		}
+	}
+	if rc != C.ZOK && err == nil {
+		err = zkError(rc, cerr, "multi", "")
+	}
+	return results, err
+}
+
+// -----------------------------------------------------------------------
+// Backoff policies.
+
+// BackoffPolicy determines how long to wait before retrying an
+// operation.  NextDelay is called with the number of attempts made so
+// far, starting at 1 before the first retry.
+type BackoffPolicy interface {
+	NextDelay(attempt int) time.Duration
+}
+
+// ConstantBackoff waits for the same delay before every retry.
+type ConstantBackoff struct {
+	Delay time.Duration
+}
+
+func (b ConstantBackoff) NextDelay(attempt int) time.Duration {
+	return b.Delay
+}
+
+// ExponentialBackoff waits for Initial before the first retry, and
+// doubles the delay before each of the following ones, up to Max.
+// A zero Max leaves the delay unbounded.
+type ExponentialBackoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+func (b ExponentialBackoff) NextDelay(attempt int) time.Duration {
+	delay := b.Initial
+	for i := 1; i < attempt; i++ {
+		if b.Max > 0 && delay >= b.Max || delay > math.MaxInt64/2 {
+			break
+		}
+		delay *= 2
+	}
+	if b.Max > 0 && delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// JitteredBackoff randomizes the delays of Policy, picking each of them
+// uniformly between half and the whole of the delay Policy suggests.
+// This spreads out the retries of clients that failed at the same time,
+// rather than having them hit the server again all at once.
+type JitteredBackoff struct {
+	Policy BackoffPolicy
+}
+
+func (b JitteredBackoff) NextDelay(attempt int) time.Duration {
+	delay := b.Policy.NextDelay(attempt)
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return delay - half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// SetBackoff sets the policy used by conn to wait between the retries
+// of the RetryChange methods.  By default, or if policy is nil, they
+// retry right away.
+func (conn *Conn) SetBackoff(policy BackoffPolicy) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.backoff = policy
+}
+
+// backoffDelay returns how long to wait after the given
+// number of attempts, according to the policy of conn.
+func (conn *Conn) backoffDelay(attempt int) time.Duration {
+	conn.mutex.RLock()
+	policy := conn.backoff
+	conn.mutex.RUnlock()
+	if policy == nil {
+		return 0
+	}
+	return policy.NextDelay(attempt)
+}
+
+// -----------------------------------------------------------------------
+// RetryChange utility method.
+
+type ChangeFunc func(oldValue string, oldStat *Stat) (newValue string, err error)
+
+// RetryChange runs changeFunc to attempt to atomically change path
+// in a lock free manner, and retries in case there was another
+// concurrent change between reading and writing the node.
+//
+// changeFunc must work correctly if called multiple times in case
+// the modification fails due to concurrent changes, and it may return
+// an error that will cause the the RetryChange function to stop and
+// return the same error.
+//
+// This mechanism is not suitable for a node that is frequently modified
+// concurrently. For those cases, consider using a pessimistic locking
+// mechanism, or bounding the retries with RetryChangeN or
+// RetryChangeTimeout.  The retries are spaced out according to the
+// policy set with SetBackoff, if any.
+//
+// This is the detailed operation flow for RetryChange:
+//
+// 1. Attempt to read the node. In case the node exists, but reading it
+// fails, stop and return the error found.
+//
+// 2. Call the changeFunc with the current node value and stat,
+// or with an empty string and nil stat, if the node doesn't yet exist.
+// If the changeFunc returns an error, stop and return the same error.
+//
+// 3. If the changeFunc returns no errors, use the string returned as
+// the new candidate value for the node, and attempt to either create
+// the node, if it didn't exist, or to change its contents at the specified
+// version.  If this procedure fails due to conflicts (concurrent changes
+// in the same node), repeat from step 1.  If this procedure fails with any
+// other error, stop and return the error found.
+func (conn *Conn) RetryChange(path string, flags int, acl []ACL, changeFunc ChangeFunc) error {
+	return conn.retryChange(path, flags, acl, ignoreAttempt(changeFunc), 0, time.Time{})
+}
+
+// ChangeFuncN is the equivalent of ChangeFunc for RetryChangeWith.
+// It's also given the number of the attempt being made, starting at 1.
+type ChangeFuncN func(oldValue string, oldStat *Stat, attempt int) (newValue string, err error)
+
+// RetryChangeWith works like RetryChange, but changeFunc is also told
+// how many attempts were made so far, including the current one, which
+// lets it give up or log when contention is high.
+func (conn *Conn) RetryChangeWith(path string, flags int, acl []ACL, changeFunc ChangeFuncN) error {
+	return conn.retryChange(path, flags, acl, func(oldValue string, oldStat *Stat, attempt int) (string, []ACL, error) {
+		newValue, err := changeFunc(oldValue, oldStat, attempt)
+		return newValue, nil, err
+	}, 0, time.Time{})
+}
+
+// ChangeACLFunc is the equivalent of ChangeFunc for RetryChangeACL.
+// It also returns the ACL to create the node with, if it doesn't exist.
+type ChangeACLFunc func(oldValue string, oldStat *Stat) (newValue string, aclv []ACL, err error)
+
+// RetryChangeACL works like RetryChange, but when the node doesn't
+// exist, it's created with the ACL returned by changeFunc, so that
+// the ACL may depend on the value, as when it embeds the identity of
+// the creator.  If changeFunc returns a nil ACL, acl is used instead.
+// The ACL of an existing node is left alone.
+func (conn *Conn) RetryChangeACL(path string, flags int, acl []ACL, changeFunc ChangeACLFunc) error {
+	return conn.retryChange(path, flags, acl, func(oldValue string, oldStat *Stat, attempt int) (string, []ACL, error) {
+		return changeFunc(oldValue, oldStat)
+	}, 0, time.Time{})
+}
+
+// retryChangeFunc is the change function used internally by
+// retryChange, which all of the others are adapted to.
+type retryChangeFunc func(oldValue string, oldStat *Stat, attempt int) (newValue string, aclv []ACL, err error)
+
+// ignoreAttempt adapts changeFunc to the retryChangeFunc signature.
+func ignoreAttempt(changeFunc ChangeFunc) retryChangeFunc {
+	return func(oldValue string, oldStat *Stat, attempt int) (string, []ACL, error) {
+		newValue, err := changeFunc(oldValue, oldStat)
+		return newValue, nil, err
+	}
+}
+
+// ChangeBytesFunc is the equivalent of ChangeFunc for RetryChangeBytes.
+type ChangeBytesFunc func(oldValue []byte, oldStat *Stat) (newValue []byte, err error)
+
+// RetryChangeBytes works like RetryChange, but hands the node data to
+// changeFunc as a byte slice, which is more convenient for binary
+// payloads.  oldValue is nil if the node doesn't yet exist.
+func (conn *Conn) RetryChangeBytes(path string, flags int, acl []ACL, changeFunc ChangeBytesFunc) error {
+	return conn.RetryChange(path, flags, acl, func(oldValue string, oldStat *Stat) (string, error) {
+		var old []byte
+		if oldStat != nil {
+			old = []byte(oldValue)
+		}
+		newValue, err := changeFunc(old, oldStat)
+		return string(newValue), err
+	})
+}
+
+// ErrContention is returned by RetryChangeN when the node kept being
+// changed concurrently for all of the allowed attempts.
+var ErrContention = errors.New("zookeeper: retrychange: too much contention")
+
+// RetryChangeN works like RetryChange, but gives up after changeFunc has
+// been attempted maxAttempts times without the change succeeding due to
+// concurrent changes, in which case ErrContention is returned.
+func (conn *Conn) RetryChangeN(path string, flags int, acl []ACL, changeFunc ChangeFunc, maxAttempts int) error {
+	return conn.retryChange(path, flags, acl, ignoreAttempt(changeFunc), maxAttempts, time.Time{})
+}
+
+// RetryChangeTimeout works like RetryChange, but gives up once the
+// change hasn't succeeded within the given timeout due to concurrent
+// changes, in which case a ZOPERATIONTIMEOUT error is returned.  An
+// attempt already in progress when the timeout expires is completed.
+func (conn *Conn) RetryChangeTimeout(path string, flags int, acl []ACL, changeFunc ChangeFunc, timeout time.Duration) error {
+	return conn.retryChange(path, flags, acl, ignoreAttempt(changeFunc), 0, time.Now().Add(timeout))
+}
+
+// retryChange implements RetryChange, with attempts bounded by
+// maxAttempts and deadline unless they are zero.
+func (conn *Conn) retryChange(path string, flags int, acl []ACL, changeFunc retryChangeFunc, maxAttempts int, deadline time.Time) error {
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			if maxAttempts > 0 && attempt > maxAttempts {
+				return ErrContention
+			}
+			if delay := conn.backoffDelay(attempt - 1); delay > 0 {
+				time.Sleep(delay)
+			}
+			if !deadline.IsZero() && time.Now().After(deadline) {
+				return zkError(C.int(ZOPERATIONTIMEOUT), nil, "retrychange", path)
+			}
+		}
+		oldValue, oldStat, err := conn.Get(path)
+		if err != nil && !IsError(err, ZNONODE) {
+			return err
+		}
+		newValue, newACL, err := changeFunc(oldValue, oldStat, attempt)
+		if err != nil {
+			return err
+		}
+		if oldStat == nil {
+			if newACL == nil {
+				newACL = acl
+			}
+			_, err := conn.Create(path, newValue, flags, newACL)
+			if err == nil || !IsError(err, ZNODEEXISTS) {
+				return err
+			}
+			continue
+		}
+		if newValue == oldValue {
+			return nil // Nothing to do.
+		}
+		_, err = conn.Set(path, newValue, oldStat.Version())
+		if err == nil || !IsError(err, ZBADVERSION) && !IsError(err, ZNONODE) {
+			return err
+		}
+	}
+}
+
+// Upsert leaves the node at path holding value, creating it as a
+// persistent node with the given ACL if it doesn't exist, or replacing
+// its data regardless of its version otherwise.  Unlike RetryChange,
+// the current data isn't read, so Upsert doesn't conflict with other
+// writers of the node, and only retries when the node is concurrently
+// created or deleted.
+//
+// The returned Stat is that of the node right after value was set.
+// When Upsert creates the node, it's read afterwards instead, and may
+// already reflect changes made by others in the meantime.
+func (conn *Conn) Upsert(path, value string, aclv []ACL) (*Stat, error) {
+	for {
+		stat, err := conn.Set(path, value, -1)
+		if !IsError(err, ZNONODE) {
+			return stat, err
+		}
+		_, err = conn.Create(path, value, 0, aclv)
+		if err == nil {
+			stat, err = conn.Exists(path)
+			if err != nil || stat != nil {
+				return stat, err
+			}
+			// Deleted already; create it again.
+		} else if !IsError(err, ZNODEEXISTS) {
+			return nil, err
+		}
+	}
+}
+
+// -----------------------------------------------------------------------
+// Codecs for typed node data.
+
+// Codec converts values to and from the data stored in nodes.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSONCodec and GobCodec encode values with the encoding/json and
+// encoding/gob packages respectively.
+var (
+	JSONCodec Codec = jsonCodec{}
+	GobCodec  Codec = gobCodec{}
+)
+
+// DecodeError is returned when the data of a node can't be decoded
+// into a value, as opposed to failing to read the node itself.
+type DecodeError struct {
+	Path string
+	Err  error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("zookeeper: cannot decode data of %q: %v", e.Path, e.Err)
+}
+
+// GetCodec reads the node at path and decodes its data into v using
+// codec.  A *DecodeError is returned if the data can't be decoded.
+func (conn *Conn) GetCodec(path string, codec Codec, v interface{}) (*Stat, error) {
+	data, stat, err := conn.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Unmarshal([]byte(data), v); err != nil {
+		return nil, &DecodeError{path, err}
+	}
+	return stat, nil
+}
+
+// SetCodec encodes v using codec and stores the result as the data
+// of the node at path, as Set does.
+func (conn *Conn) SetCodec(path string, codec Codec, v interface{}, version int) (*Stat, error) {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Set(path, string(data), version)
+}
+
+// GetJSON works like GetCodec with JSONCodec.
+func (conn *Conn) GetJSON(path string, v interface{}) (*Stat, error) {
+	return conn.GetCodec(path, JSONCodec, v)
+}
+
+// SetJSON works like SetCodec with JSONCodec.
+func (conn *Conn) SetJSON(path string, v interface{}, version int) (*Stat, error) {
+	return conn.SetCodec(path, JSONCodec, v, version)
+}
+
+// GetGob works like GetCodec with GobCodec.
+func (conn *Conn) GetGob(path string, v interface{}) (*Stat, error) {
+	return conn.GetCodec(path, GobCodec, v)
+}
+
+// SetGob works like SetCodec with GobCodec.
+func (conn *Conn) SetGob(path string, v interface{}, version int) (*Stat, error) {
+	return conn.SetCodec(path, GobCodec, v, version)
+}
+
+// RetryChangeCodec works like RetryChange, but on typed values.  The
+// value parameter must be a pointer.  On every attempt, the value it
+// points to is reset to its zero value and the current data of the node,
+// if it exists, is decoded into it using codec.  changeFunc is then
+// called to modify the value, which is encoded back as the new data
+// of the node.
+func (conn *Conn) RetryChangeCodec(path string, flags int, acl []ACL, codec Codec, value interface{}, changeFunc func(stat *Stat) error) error {
+	elem := reflect.ValueOf(value).Elem()
+	return conn.RetryChangeBytes(path, flags, acl, func(oldValue []byte, oldStat *Stat) ([]byte, error) {
+		elem.Set(reflect.Zero(elem.Type()))
+		if oldStat != nil {
+			if err := codec.Unmarshal(oldValue, value); err != nil {
+				return nil, &DecodeError{path, err}
+			}
+		}
+		if err := changeFunc(oldStat); err != nil {
+			return nil, err
+		}
+		return codec.Marshal(value)
+	})
+}
+
+// -----------------------------------------------------------------------
+// WaitVersion utility method.
+
+// WaitVersion blocks until the node at path reaches at least the given
+// version, and returns its status at that point.  The node is watched
+// for changes in the meantime, rather than polled.
+//
+// If the node doesn't exist or is deleted while waiting, a ZNONODE error
+// is returned.  If the version isn't reached within the given timeout,
+// a ZOPERATIONTIMEOUT error is returned.  Critical session events
+// interrupt the wait with a ZCONNECTIONLOSS, ZSESSIONEXPIRED, ZAUTHFAILED
+// or ZCLOSING error, as appropriate.
+func (conn *Conn) WaitVersion(path string, minVersion int, timeout time.Duration) (*Stat, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		// Bypass shared watches, so that the watch may be removed.
+		_, stat, _, watch, err := conn.getW(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if stat.Version() >= minVersion {
+			conn.removeWatch(path, watch)
+			return stat, nil
+		}
+		select {
+		case event := <-watch:
+			if !event.Ok() {
+				return nil, eventError(event, "waitversion", path)
+			}
+		case <-timer.C:
+			conn.removeWatch(path, watch)
+			return nil, zkError(C.int(ZOPERATIONTIMEOUT), nil, "waitversion", path)
+		}
+	}
+}
+
+// ErrWaitCanceled is returned by WaitExistsCancel when
+// the wait is canceled.
+var ErrWaitCanceled = errors.New("zookeeper: wait canceled")
+
+// WaitExistsCancel blocks until a node exists at path, and returns its
+// status at that point.  The node is watched for creation in the
+// meantime, rather than polled.  If the cancel channel is closed before
+// the node is created, the wait is abandoned and ErrWaitCanceled is
+// returned, with the underlying watch removed so that it doesn't linger
+// until the node is eventually created.  Critical session events
+// interrupt the wait with a ZCONNECTIONLOSS, ZSESSIONEXPIRED, ZAUTHFAILED
+// or ZCLOSING error, as appropriate.
+func (conn *Conn) WaitExistsCancel(path string, cancel <-chan struct{}) (*Stat, error) {
+	for {
+		// Bypass shared watches, so that the watch may be removed.
+		stat, watch, err := conn.existsW(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if stat != nil {
+			conn.removeWatch(path, watch)
+			return stat, nil
+		}
+		select {
+		case event := <-watch:
+			if !event.Ok() {
+				return nil, eventError(event, "waitexists", path)
+			}
+		case <-cancel:
+			conn.removeWatch(path, watch)
+			return nil, ErrWaitCanceled
+		}
+	}
+}
+
+// removeWatch removes the data watch on path which delivers its event
+// to watch, which must not be visible to anyone else.  The watch is
+// forgotten right away, and also removed from the C library when it
+// supports FEATURE_REMOVE_WATCHES, so that it's not left waiting for
+// an event that may never happen.
+func (conn *Conn) removeWatch(path string, watch <-chan Event) {
+	var watchId uintptr
+	found := false
+	watchMutex.Lock()
+	for id, ch := range conn.watchChannels {
+		if ch == watch {
+			watchId, found = id, true
+			break
+		}
+	}
+	watchMutex.Unlock()
+	if !found {
+		// Already fired.
+		return
+	}
+	conn.forgetWatch(watchId)
+
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil || !Supported(FEATURE_REMOVE_WATCHES) {
+		return
+	}
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+	// ZWATCHTYPE_DATA, which isn't defined by older headers.
+	const dataWatch = 2
+	C.zoo_remove_watchers_int(conn.handle, cpath, dataWatch, C.watch_handler, C.ulong(watchId), 1)
+}
+
+// -----------------------------------------------------------------------
+// WatchChildren utility method.
+
+// ChildrenDelta describes a change in the children of a node,
+// as delivered by WatchChildren.
+type ChildrenDelta struct {
+	Added   []string
+	Removed []string
+}
+
+// WatchChildren returns a channel that receives a ChildrenDelta each
+// time children are added to or removed from the node at path.  The
+// first delta received reports all the existing children as added.
+// The last known set of children is maintained internally, and the
+// underlying ChildrenW watch is reestablished automatically after
+// it fires.
+//
+// When the node is deleted, a final delta reporting all the known
+// children as removed is delivered, and the channel is closed.  The
+// channel is also closed when the watch is interrupted by a session
+// event or an error, including the connection being closed, in which
+// case the application should reestablish its state from scratch.
+// The channel must be read from until it is closed, or the resources
+// held by the watch will leak.
+func (conn *Conn) WatchChildren(path string) (<-chan ChildrenDelta, error) {
+	return conn.WatchChildrenDebounced(path, 0)
+}
+
+// WatchChildrenDebounced works like WatchChildren, but once the
+// children change it waits for the given interval before fetching
+// them again, so that a burst of changes is coalesced into a single
+// delta rather than flooding the receiver.
+func (conn *Conn) WatchChildrenDebounced(path string, interval time.Duration) (<-chan ChildrenDelta, error) {
+	children, _, watch, err := conn.ChildrenW(path)
+	if err != nil {
+		return nil, err
+	}
+	deltas := make(chan ChildrenDelta)
+	go conn.watchChildren(path, interval, children, watch, deltas)
+	return deltas, nil
+}
+
+func (conn *Conn) watchChildren(path string, interval time.Duration, children []string, watch <-chan Event, deltas chan<- ChildrenDelta) {
+	defer close(deltas)
+	var known []string
+	// The initial snapshot is always delivered, even if empty.
+	pending := true
+	for {
+		// Keep watching while a delta is waiting to be received,
+		// so that a closed connection doesn't block us forever.
+		var send chan<- ChildrenDelta
+		var delta ChildrenDelta
+		if pending {
+			send = deltas
+			delta = childrenDelta(known, children)
+		}
+		select {
+		case send <- delta:
+			known = children
+			pending = false
+			continue
+		case event := <-watch:
+			if !event.Ok() {
+				return
+			}
+		}
+		if interval > 0 {
+			time.Sleep(interval)
+		}
+		var err error
+		children, _, watch, err = conn.ChildrenW(path)
+		if IsError(err, ZNONODE) {
+			if delta := childrenDelta(known, nil); len(delta.Removed) > 0 {
+				deltas <- delta
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+		delta = childrenDelta(known, children)
+		pending = pending || len(delta.Added) > 0 || len(delta.Removed) > 0
+	}
+}
+
+// childrenDelta returns the changes necessary to turn the
+// children before into the children after.
+func childrenDelta(before, after []string) ChildrenDelta {
+	var delta ChildrenDelta
+	beforeSet := make(map[string]bool)
+	for _, name := range before {
+		beforeSet[name] = true
+	}
+	afterSet := make(map[string]bool)
+	for _, name := range after {
+		afterSet[name] = true
+		if !beforeSet[name] {
+			delta.Added = append(delta.Added, name)
+		}
+	}
+	for _, name := range before {
+		if !afterSet[name] {
+			delta.Removed = append(delta.Removed, name)
+		}
+	}
+	return delta
+}
+
+// -----------------------------------------------------------------------
+// WatchTree utility method.
+
+// TreeState holds the state of a node watched with WatchTree.  While
+// the node exists, Exists is true and Children holds its children.
+// Once it is deleted, Exists is false and Children is nil.
+type TreeState struct {
+	Exists   bool
+	Children []string
+}
+
+// WatchTree returns a channel that receives the state of the node at
+// path and its children, first as it currently is and then every time
+// it changes.  Unlike WatchChildren, the watch survives the node being
+// deleted and created again: a state with Exists set to false is
+// delivered when the node disappears, and watching of its children
+// resumes once it is back.  The node doesn't have to exist when
+// WatchTree is called.  If the receiver falls behind, intermediate
+// states are skipped, and only the latest one is delivered.
+//
+// The channel is closed when the watch is interrupted by a session
+// event or an error, including the connection being closed.  The
+// channel must be read from until it is closed, or the resources held
+// by the watch will leak.
+func (conn *Conn) WatchTree(path string) (<-chan TreeState, error) {
+	state, watch, err := conn.fetchTree(path)
+	if err != nil {
+		return nil, err
+	}
+	states := make(chan TreeState)
+	go conn.watchTree(path, state, watch, states)
+	return states, nil
+}
+
+// fetchTree returns the current state of the node at path, and a watch
+// that fires on its next change.  That's a children watch while the
+// node exists, and an existence watch otherwise.
+func (conn *Conn) fetchTree(path string) (TreeState, <-chan Event, error) {
+	for {
+		children, _, watch, err := conn.ChildrenW(path)
+		if err == nil {
+			return TreeState{true, children}, watch, nil
+		}
+		if !IsError(err, ZNONODE) {
+			return TreeState{}, nil, err
+		}
+		// Bypass shared watches, so that the watch may be removed.
+		stat, watch, err := conn.existsW(path, nil)
+		if err != nil {
+			return TreeState{}, nil, err
+		}
+		if stat == nil {
+			return TreeState{}, watch, nil
+		}
+		// The node was created in the meantime, and its existence
+		// watch won't fire until it changes, so drop it and try again.
+		conn.removeWatch(path, watch)
+	}
+}
+
+func (conn *Conn) watchTree(path string, state TreeState, watch <-chan Event, states chan<- TreeState) {
+	defer close(states)
+	pending := true
+	for {
+		var send chan<- TreeState
+		if pending {
+			send = states
+		}
+		select {
+		case send <- state:
+			pending = false
+			continue
+		case event := <-watch:
+			if !event.Ok() {
+				return
+			}
+		}
+		var err error
+		state, watch, err = conn.fetchTree(path)
+		if err != nil {
+			return
+		}
+		pending = true
+	}
+}
+
+// -----------------------------------------------------------------------
+// Persistent watches.
+
+// Modes for AddWatch.
+const (
+	ADD_WATCH_PERSISTENT           = 0
+	ADD_WATCH_PERSISTENT_RECURSIVE = 1
+)
+
+// AddWatch establishes a persistent watch on path, and returns the
+// channel that receives its events.  Unlike the watches established
+// by GetW, ChildrenW and ExistsW, a persistent watch isn't removed
+// once it fires, and the channel receives every event observed on the
+// node for as long as the watch lasts.  With ADD_WATCH_PERSISTENT, the
+// events are those that would fire data and children watches on the
+// node; with ADD_WATCH_PERSISTENT_RECURSIVE, they report the creation,
+// deletion and change of any node in the tree rooted at path.
+//
+// The channel is closed after delivering an event that is not Ok,
+// such as critical session events, as happens with other watches.  It
+// is also closed, without any further event, if the application falls
+// so far behind that the channel buffer is filled up.
+//
+// Persistent watches require ZooKeeper 3.6 or later, and a C library
+// providing them (see FEATURE_ADD_WATCH).
+func (conn *Conn) AddWatch(path string, mode int) (watch <-chan Event, err error) {
+	conn.mutex.RLock()
+	defer conn.mutex.RUnlock()
+	if conn.handle == nil {
+		return nil, closingError("addwatch", path)
+	}
+	if err = conn.breaker.allow(); err != nil {
+		return nil, err
+	}
+	defer func() { conn.breaker.record(err) }()
+
+	cpath := C.CString(path)
+	defer C.free(unsafe.Pointer(cpath))
+
+	watchId, watchChannel := conn.createPersistentWatch()
+	conn.describeWatch(watchId, "persistent", path)
+
+	rc, cerr := C.zoo_add_watch_int(conn.handle, cpath, C.int(mode), C.watch_handler, C.ulong(watchId))
+	if rc != C.ZOK {
+		conn.forgetWatch(watchId)
+		return nil, zkError(rc, cerr, "addwatch", path)
+	}
+	return watchChannel, nil
+}
+
+// SubtreeEvent reports a change to a node in a tree watched with
+// WatchSubtree.  Type is one of EVENT_CREATED, EVENT_DELETED and
+// EVENT_CHANGED, and Path is the path of the affected node.
+type SubtreeEvent struct {
+	Type int
+	Path string
+}
+
+// WatchSubtree returns a channel that receives a SubtreeEvent for
+// every node created, deleted or changed in the tree rooted at root,
+// including root itself.  A single persistent recursive watch is
+// established with AddWatch for the whole tree, rather than one watch
+// per node.  Events are queued while the receiver falls behind, so
+// that none are lost.
+//
+// The channel is closed, after delivering the events queued, when the
+// watch is interrupted by a session event or the connection being
+// closed, after which the tree must be read again to learn about any
+// changes missed.
+func (conn *Conn) WatchSubtree(root string) (<-chan SubtreeEvent, error) {
+	watch, err := conn.AddWatch(root, ADD_WATCH_PERSISTENT_RECURSIVE)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan SubtreeEvent)
+	go watchSubtree(watch, events)
+	return events, nil
+}
+
+func watchSubtree(watch <-chan Event, events chan<- SubtreeEvent) {
+	defer close(events)
+	var queue []SubtreeEvent
+	for watch != nil || len(queue) > 0 {
+		var send chan<- SubtreeEvent
+		var next SubtreeEvent
+		if len(queue) > 0 {
+			send, next = events, queue[0]
+		}
+		select {
+		case send <- next:
+			queue = queue[1:]
+		case event, ok := <-watch:
+			if !ok || !event.Ok() {
+				watch = nil
+				continue
+			}
+			queue = append(queue, SubtreeEvent{event.Type, event.Path})
+		}
+	}
+}
+
+// -----------------------------------------------------------------------
+// Observe utility method.
+
+// NodeState holds the contents of a node, as delivered by Observe.
+type NodeState struct {
+	Data string
+	Stat *Stat
+}
+
+// Observe returns a channel that receives the state of the node at
+// path, first as it currently is and then every time it changes.  The
+// underlying GetW watch is reestablished automatically after it fires.
+// If the receiver falls behind, intermediate states are skipped, and
+// only the latest one is delivered.
+//
+// The channel is closed when the node is deleted, or when the watch is
+// interrupted by a session event or an error, including the connection
+// being closed.  The channel must be read from until it is closed, or
+// the resources held by the watch will leak.
+func (conn *Conn) Observe(path string) (<-chan NodeState, error) {
+	return conn.ObserveDebounced(path, 0)
+}
+
+// ObserveDebounced works like Observe, but once the node changes it
+// waits for the given interval before fetching it again, so that a
+// burst of changes results in the delivery of the latest state only.
+func (conn *Conn) ObserveDebounced(path string, interval time.Duration) (<-chan NodeState, error) {
+	return conn.startObserve(path, interval, false)
+}
+
+// ObserveDistinct works like ObserveDebounced, but a state is only
+// delivered if its data differs from that of the previous one.  Sets
+// that write the same data again still make the node change, and are
+// otherwise delivered even though nothing the application cares about
+// changed.  The interval may be zero to disable debouncing.
+func (conn *Conn) ObserveDistinct(path string, interval time.Duration) (<-chan NodeState, error) {
+	return conn.startObserve(path, interval, true)
+}
+
+func (conn *Conn) startObserve(path string, interval time.Duration, distinct bool) (<-chan NodeState, error) {
+	data, stat, watch, err := conn.GetW(path)
+	if err != nil {
+		return nil, err
+	}
+	states := make(chan NodeState)
+	go conn.observe(path, interval, distinct, NodeState{data, stat}, watch, states)
+	return states, nil
+}
+
+func (conn *Conn) observe(path string, interval time.Duration, distinct bool, state NodeState, watch <-chan Event, states chan<- NodeState) {
+	defer close(states)
+	pending := true
+	// delivered holds the data last received from states, if any.
+	var delivered string
+	var hasDelivered bool
+	for {
+		// Keep watching while a state is waiting to be received,
+		// so that a closed connection doesn't block us forever.
+		var send chan<- NodeState
+		if pending {
+			send = states
+		}
+		select {
+		case send <- state:
+			pending = false
+			delivered, hasDelivered = state.Data, true
+			continue
+		case event := <-watch:
+			if !event.Ok() || event.Type == EVENT_DELETED {
+				return
+			}
+		}
+		if interval > 0 {
+			time.Sleep(interval)
+		}
+		data, stat, nextWatch, err := conn.GetW(path)
+		if err != nil {
+			return
+		}
+		watch = nextWatch
+		if distinct && hasDelivered && data == delivered {
+			// The node went back to the data last delivered, so
+			// any state still pending is dropped as well.
+			state, pending = NodeState{data, stat}, false
+			continue
+		}
+		state, pending = NodeState{data, stat}, true
+	}
+}
+
+// -----------------------------------------------------------------------
+// Ephemeral nodes.
+
+// EphemeralNode is a handle for an ephemeral node created with
+// CreateEphemeral, which allows keeping the node alive as long
+// as the application wants it.
+type EphemeralNode struct {
+	conn  *Conn
+	path  string
+	value string
+	aclv  []ACL
+}
+
+// CreateEphemeral creates an ephemeral node at path, as Create does
+// with the EPHEMERAL flag, and returns a handle for it.  The handle
+// remains registered with conn, and is listed by conn.Ephemerals,
+// until it is released.
+func (conn *Conn) CreateEphemeral(path, value string, aclv []ACL) (*EphemeralNode, error) {
+	_, err := conn.Create(path, value, EPHEMERAL, aclv)
+	if err != nil {
+		return nil, err
+	}
+	node := &EphemeralNode{conn: conn, path: path, value: value, aclv: aclv}
+	conn.ephemeralsMutex.Lock()
+	if conn.ephemerals == nil {
+		conn.ephemerals = make(map[*EphemeralNode]bool)
+	}
+	conn.ephemerals[node] = true
+	conn.ephemeralsMutex.Unlock()
+	return node, nil
+}
+
+// Ephemerals returns the nodes created with CreateEphemeral on conn
+// that haven't been released, so that they may be refreshed at once.
+func (conn *Conn) Ephemerals() []*EphemeralNode {
+	conn.ephemeralsMutex.Lock()
+	defer conn.ephemeralsMutex.Unlock()
+	nodes := make([]*EphemeralNode, 0, len(conn.ephemerals))
+	for node := range conn.ephemerals {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// Path returns the path of the node.
+func (node *EphemeralNode) Path() string {
+	return node.path
+}
+
+// Refresh creates the node again with its original value and ACL if
+// it doesn't exist anymore, as happens when it is removed or when the
+// session that created it is gone.  It does nothing if the node exists
+// and is owned by the current session, and fails with ZNODEEXISTS if
+// the node is owned by another session.
+func (node *EphemeralNode) Refresh() error {
+	for {
+		stat, err := node.conn.Exists(node.path)
+		if err != nil {
+			return err
+		}
+		if stat != nil {
+			if node.conn.OwnsNode(stat) {
+				return nil
+			}
+			return &Error{Op: "refresh", Code: ZNODEEXISTS, Path: node.path}
+		}
+		_, err = node.conn.Create(node.path, node.value, EPHEMERAL, node.aclv)
+		if !IsError(err, ZNODEEXISTS) {
+			return err
+		}
+		// Created concurrently; check who owns it.
+	}
+}
+
+// Release deletes the node, if it still exists and is owned by the
+// current session, and unregisters it from the connection it is bound
+// to.  A node created again by another session, as may happen after
+// the session that created it is lost, is left alone.
+func (node *EphemeralNode) Release() error {
+	node.conn.ephemeralsMutex.Lock()
+	delete(node.conn.ephemerals, node)
+	node.conn.ephemeralsMutex.Unlock()
+	for {
+		stat, err := node.conn.Exists(node.path)
+		if err != nil || stat == nil || !node.conn.OwnsNode(stat) {
+			return err
+		}
+		err = node.conn.Delete(node.path, stat.Version())
+		if !IsError(err, ZNONODE) && !IsError(err, ZBADVERSION) {
+			return err
+		}
+		// Changed concurrently; check again.
+	}
+}
+
+// Rebind moves the registration of the node to conn, such as a new
+// connection established after the session of the one it was created
+// with is lost, and refreshes it there, creating the node again with
+// the new session if it's gone.  Once Rebind is called, the node is
+// listed by conn.Ephemerals rather than by those of the old connection,
+// and Refresh and Release use conn, even if refreshing it fails.
+func (node *EphemeralNode) Rebind(conn *Conn) error {
+	old := node.conn
+	old.ephemeralsMutex.Lock()
+	delete(old.ephemerals, node)
+	old.ephemeralsMutex.Unlock()
+	node.conn = conn
+	conn.ephemeralsMutex.Lock()
+	if conn.ephemerals == nil {
+		conn.ephemerals = make(map[*EphemeralNode]bool)
+	}
+	conn.ephemerals[node] = true
+	conn.ephemeralsMutex.Unlock()
+	return node.Refresh()
+}
+
+// -----------------------------------------------------------------------
+// DeleteRecursive utility methods.
+
+// DeleteRecursiveDryRun walks the tree rooted at path and returns the
+// paths that DeleteRecursive would remove, in the order it would remove
+// them, with every node listed before its parent.  Nothing is deleted,
+// so this allows reviewing the effect of a deletion before committing
+// to it.  Siblings are listed in lexical order.
+func (conn *Conn) DeleteRecursiveDryRun(path string) ([]string, error) {
+	var plan []string
+	if err := conn.planDelete(path, &plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (conn *Conn) planDelete(path string, plan *[]string) error {
+	children, _, err := conn.Children(path)
+	if err != nil {
+		return err
+	}
+	sort.Strings(children)
+	for _, child := range children {
+		childPath := path + "/" + child
+		if path == "/" {
+			childPath = path + child
+		}
+		if err := conn.planDelete(childPath, plan); err != nil && !IsError(err, ZNONODE) {
+			return err
+		}
+	}
+	*plan = append(*plan, path)
+	return nil
+}
+
+// DeleteRecursive removes the node at path along with all of
+// its descendants.
+func (conn *Conn) DeleteRecursive(path string) error {
+	plan, err := conn.DeleteRecursiveDryRun(path)
+	if err != nil {
+		return err
+	}
+	return conn.DeleteRecursivePlan(plan)
+}
+
+// DeleteRecursiveIfExists works like DeleteRecursive, but a node
+// that doesn't exist is not an error.  deleted reports whether
+// the node was found, and deleted along with its descendants.
+func (conn *Conn) DeleteRecursiveIfExists(path string) (deleted bool, err error) {
+	err = conn.DeleteRecursive(path)
+	if IsError(err, ZNONODE) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// DeleteRecursivePlan removes the nodes in plan, as returned by
+// DeleteRecursiveDryRun, in order.  The tree may have changed since
+// the plan was computed: nodes already removed are skipped, and nodes
+// which gained new children are removed along with them.
+func (conn *Conn) DeleteRecursivePlan(plan []string) error {
+	for _, path := range plan {
+		err := conn.Delete(path, -1)
+		if IsError(err, ZNOTEMPTY) {
+			err = conn.DeleteRecursive(path)
+		}
+		if err != nil && !IsError(err, ZNONODE) {
+			return err
+		}
+	}
+	return nil
+}
+
+// -----------------------------------------------------------------------
+// Lock recipe.
+
+// ErrLockHeld is returned when acquiring a Lock that is already held.
+var ErrLockHeld = errors.New("zookeeper: lock already held")
+
+// ErrLockNotHeld is returned when releasing a Lock that isn't held.
+var ErrLockNotHeld = errors.New("zookeeper: lock not held")
+
+// lockPrefix is the prefix of the sequential nodes created
+// under the lock directory by contenders.
+const lockPrefix = "lock-"
+
+// Lock implements the ZooKeeper lock recipe.  Contenders create
+// ephemeral sequential nodes under a common directory, and the owner
+// of the lowest numbered node holds the lock.  Each contender watches
+// only the node right before its own, so that releasing the lock
+// wakes up a single waiter.
+//
+// A Lock value must not be used concurrently by several goroutines.
+// Goroutines contending for the same lock should each use a Lock of
+// their own.
+type Lock struct {
+	conn  *Conn
+	path  string
+	aclv  []ACL
+	node  string
+	lease time.Duration
+
+	// stop and expired are set while a lock with a lease is held.
+	stop    chan struct{}
+	expired chan struct{}
+}
+
+// NewLock returns a Lock that contends using nodes created under the
+// directory at path, with the given ACL.  The directory is created
+// when needed, but its parent must exist.
+func NewLock(conn *Conn, path string, aclv []ACL) *Lock {
+	return &Lock{conn: conn, path: path, aclv: aclv}
+}
+
+// NewLockWithLease works like NewLock, but the returned Lock is only
+// held for up to the given lease every time it is acquired.  If Unlock
+// isn't called within the lease, the lock is released by deleting its
+// node, and the channel returned by Expired is closed.  This bounds
+// how long a holder that hangs or forgets to unlock can block other
+// contenders, which would otherwise wait until its session expires.
+//
+// Note that the lease gives up on mutual exclusion: once it expires,
+// another contender may acquire the lock while the original holder is
+// still running, and both may end up doing the work the lock was meant
+// to protect.  Holders must either finish well within the lease, or
+// check Expired and cope with the work being done twice.
+func NewLockWithLease(conn *Conn, path string, aclv []ACL, lease time.Duration) *Lock {
+	return &Lock{conn: conn, path: path, aclv: aclv, lease: lease}
+}
+
+// Expired returns a channel that is closed when the lease of the lock
+// currently held expires.  It returns nil, which blocks forever when
+// received from, if the lock isn't held or was created without a lease.
+func (l *Lock) Expired() <-chan struct{} {
+	return l.expired
+}
+
+// Lock acquires the lock, blocking until it is available.  If the
+// wait is interrupted by a session event, the contender node is
+// removed and the respective error is returned.
+func (l *Lock) Lock() error {
+	if l.node != "" {
+		return ErrLockHeld
+	}
+	node, err := l.enqueue()
+	if err != nil {
+		return err
+	}
+	for {
+		prev, err := l.predecessor(node)
+		if err == nil && prev == "" {
+			l.hold(node)
+			return nil
+		}
+		if err == nil {
+			var stat *Stat
+			var watch <-chan Event
+			// Bypass shared watches, so that the watch may be removed.
+			prevPath := l.path + "/" + prev
+			stat, watch, err = l.conn.existsW(prevPath, nil)
+			if err == nil && stat == nil {
+				// Gone already.  Sequential nodes are never created
+				// again, so the watch would never fire.
+				l.conn.removeWatch(prevPath, watch)
+				continue
+			}
+			if err == nil {
+				event := <-watch
+				if event.Ok() {
+					continue
+				}
+				err = eventError(event, "lock", l.path)
+			}
+		}
+		l.conn.Delete(node, -1)
+		return err
+	}
+}
+
+// TryLock attempts to acquire the lock without waiting for it.  If the
+// lock is held by someone else, the contender node is removed right
+// away, so that it doesn't hold a position in the queue of waiters,
+// and acquired is false.
+func (l *Lock) TryLock() (acquired bool, err error) {
+	if l.node != "" {
+		return false, ErrLockHeld
+	}
+	node, err := l.enqueue()
+	if err != nil {
+		return false, err
+	}
+	prev, err := l.predecessor(node)
+	if err == nil && prev == "" {
+		l.hold(node)
+		return true, nil
+	}
+	if derr := l.conn.Delete(node, -1); err == nil && derr != nil && !IsError(derr, ZNONODE) {
+		err = derr
+	}
+	return false, err
+}
+
+// Unlock releases the lock.  Unlocking a lock whose lease has expired
+// is not an error.
+func (l *Lock) Unlock() error {
+	if l.node == "" {
+		return ErrLockNotHeld
+	}
+	if l.stop != nil {
+		close(l.stop)
+		l.stop, l.expired = nil, nil
+	}
+	err := l.conn.Delete(l.node, -1)
+	l.node = ""
+	if IsError(err, ZNONODE) {
+		return nil
+	}
+	return err
+}
+
+// hold records that the lock was acquired with the given node,
+// and starts the lease watchdog if the lock has a lease.
+func (l *Lock) hold(node string) {
+	l.node = node
+	if l.lease <= 0 {
+		return
+	}
+	l.stop = make(chan struct{})
+	l.expired = make(chan struct{})
+	go l.watchdog(node, l.stop, l.expired)
+}
+
+// watchdog deletes node once the lease is over, unless
+// stop is closed first.
+func (l *Lock) watchdog(node string, stop, expired chan struct{}) {
+	timer := time.NewTimer(l.lease)
+	defer timer.Stop()
+	select {
+	case <-stop:
+	case <-timer.C:
+		l.conn.Delete(node, -1)
+		close(expired)
+	}
+}
+
+// enqueue creates the contender node, and the lock directory
+// if it doesn't exist yet, and returns the path of the node.
+func (l *Lock) enqueue() (string, error) {
+	for {
+		node, err := l.conn.Create(l.path+"/"+lockPrefix, "", EPHEMERAL|SEQUENCE, l.aclv)
+		if !IsError(err, ZNONODE) {
+			return node, err
+		}
+		_, err = l.conn.Create(l.path, "", 0, l.aclv)
+		if err != nil && !IsError(err, ZNODEEXISTS) {
+			return "", err
+		}
+	}
+}
+
+// predecessor returns the name of the contender node right before
+// the given one, or the empty string if node is the lowest one.
+func (l *Lock) predecessor(node string) (string, error) {
+	children, _, err := l.conn.Children(l.path)
+	if err != nil {
+		return "", err
+	}
+	name := node[len(l.path)+1:]
+	prev := ""
+	found := false
+	for _, child := range children {
+		if !strings.HasPrefix(child, lockPrefix) {
+			continue
+		}
+		if child == name {
+			found = true
+		} else if child < name && child > prev {
+			prev = child
+		}
+	}
+	if !found {
+		return "", &Error{Op: "lock", Code: ZNONODE, Path: node}
+	}
+	return prev, nil
+}
+
+// -----------------------------------------------------------------------
+// Ownership handoff recipe.
+
+// ownerPrefix is the prefix of the sequential nodes created
+// under the owner pointer by candidates.
+const ownerPrefix = "owner-"
+
+// Owner is the registration of the active owner of a role, as
+// established by TransferEphemeral.
+type Owner struct {
+	conn *Conn
+	path string
+	node string
+}
+
+// TransferEphemeral takes over the role coordinated through the owner
+// pointer at path, blocking until the current owner is gone.  It is
+// meant for failing over a role whose owner registers with an
+// ephemeral node, which the old owner keeps holding until its session
+// dies, without a moment in which readers see no owner or two of them.
+//
+// The pointer is a persistent node whose data is the path of the
+// ephemeral node registered by the current owner.  The new owner
+// creates its own ephemeral candidate node under the pointer, with the
+// given value, and waits for the node the pointer names to go away.
+// It then points the pointer at its candidate with a versioned Set,
+// so that of several candidates only one succeeds, and the others go
+// back to waiting on the winner.  The pointer thus always names a
+// single owner: the old one until the new one replaces it.  Between
+// the old owner's node disappearing and the pointer being updated the
+// named owner is no longer active, which CurrentOwner reports.
+//
+// The pointer is created when needed, but its parent must exist.  If
+// the wait is interrupted by a session event, the candidate node is
+// removed and the respective error is returned.
+func TransferEphemeral(conn *Conn, path, value string, aclv []ACL) (*Owner, error) {
+	node, err := createCandidate(conn, path, value, aclv)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var current string
+		var stat *Stat
+		current, stat, err = conn.Get(path)
+		if err != nil {
+			break
+		}
+		if current != "" && current != node {
+			var ownerStat *Stat
+			var watch <-chan Event
+			// Bypass shared watches, so that the watch may be removed.
+			ownerStat, watch, err = conn.existsW(current, nil)
+			if err != nil {
+				break
+			}
+			if ownerStat == nil {
+				// Sequential nodes are never created again,
+				// so the watch would never fire.
+				conn.removeWatch(current, watch)
+			} else {
+				event := <-watch
+				if !event.Ok() {
+					err = eventError(event, "transferephemeral", path)
+					break
+				}
+				continue
+			}
+		}
+		_, err = conn.Set(path, node, stat.Version())
+		if err == nil {
+			return &Owner{conn: conn, path: path, node: node}, nil
+		}
+		if !IsError(err, ZBADVERSION) {
+			break
+		}
+	}
+	conn.Delete(node, -1)
+	return nil, err
+}
+
+// createCandidate creates the ephemeral node of a candidate under the
+// owner pointer at path, and the pointer if it doesn't exist yet.
+func createCandidate(conn *Conn, path, value string, aclv []ACL) (string, error) {
+	for {
+		node, err := conn.Create(path+"/"+ownerPrefix, value, EPHEMERAL|SEQUENCE, aclv)
+		if !IsError(err, ZNONODE) {
+			return node, err
+		}
+		_, err = conn.Create(path, "", 0, aclv)
+		if err != nil && !IsError(err, ZNODEEXISTS) {
+			return "", err
+		}
+	}
+}
+
+// CurrentOwner returns the path of the node registered by the owner
+// the pointer at path names, and whether that owner is still active,
+// which is the case while its node exists.  The node is empty if the
+// role never had an owner.
+func CurrentOwner(conn *Conn, path string) (node string, active bool, err error) {
+	node, _, err = conn.Get(path)
+	if err != nil || node == "" {
+		return node, false, err
+	}
+	stat, err := conn.Exists(node)
+	if err != nil {
+		return "", false, err
+	}
+	return node, stat != nil, nil
+}
+
+// Node returns the path of the ephemeral node registered by the owner.
+func (o *Owner) Node() string {
+	return o.node
+}
+
+// Release gives up the role by removing the node of the owner, which
+// lets a waiting candidate take over.  The pointer keeps naming the
+// released owner until then.
+func (o *Owner) Release() error {
+	err := o.conn.Delete(o.node, -1)
+	if IsError(err, ZNONODE) {
+		return nil
+	}
+	return err
+}
+
+// -----------------------------------------------------------------------
+// Cache utility type.
+
+// Cache serves the data of nodes from memory, fetching each node once
+// and keeping it up to date by watching it for changes.
+type Cache struct {
+	conn    *Conn
+	mutex   sync.Mutex
+	entries map[string]*cacheEntry
+	closed  bool
+}
+
+type cacheEntry struct {
+	ready   chan bool
+	data    string
+	stat    *Stat
+	err     error
+	watched bool
+	watchId uintptr
+}
+
+// NewCache returns a new empty Cache for nodes reached through conn.
+func (conn *Conn) NewCache() *Cache {
+	return &Cache{conn: conn, entries: make(map[string]*cacheEntry)}
+}
+
+// Get returns the data and status of the node at path, as Conn.Get does.
+// The first call for a given path reads the node and watches it, and
+// following calls are served from memory until the watch fires.  When
+// the node changes it is fetched again and watched anew, and when it is
+// deleted it is dropped from the cache.  Session events also drop the
+// node, since its watch is closed by them, so it is fetched again by
+// the next call once the session is reestablished.  Errors, including
+// the ZNONODE error for a missing node, are not cached.
+func (cache *Cache) Get(path string) (data string, stat *Stat, err error) {
+	cache.mutex.Lock()
+	if cache.closed {
+		cache.mutex.Unlock()
+		return "", nil, closingError("cacheget", path)
+	}
+	entry, ok := cache.entries[path]
+	if !ok {
+		entry = &cacheEntry{ready: make(chan bool)}
+		cache.entries[path] = entry
+		cache.mutex.Unlock()
+		cache.fetch(path, entry)
+	} else {
+		cache.mutex.Unlock()
+		<-entry.ready
+	}
+	if entry.err != nil {
+		return "", nil, entry.err
+	}
+	// Hand out a copy so the cached status can't be changed.
+	statCopy := *entry.stat
+	return entry.data, &statCopy, nil
+}
+
+// fetch reads the node at path into entry, and watches it.
+func (cache *Cache) fetch(path string, entry *cacheEntry) {
+	data, stat, watchId, _, err := cache.conn.getW(path, func(event Event) {
+		cache.invalidate(path, entry, event)
+	})
+
+	cache.mutex.Lock()
+	entry.data, entry.stat, entry.err = data, stat, err
+	if err == nil {
+		entry.watched = true
+		entry.watchId = watchId
+		if cache.closed {
+			// Close couldn't release this watch.
+			cache.conn.forgetWatch(watchId)
+		}
+	} else if cache.entries[path] == entry {
+		delete(cache.entries, path)
+	}
+	cache.mutex.Unlock()
+	close(entry.ready)
+}
+
+// invalidate drops entry from the cache when its watch fires, and
+// fetches the node again if it was changed.
+func (cache *Cache) invalidate(path string, entry *cacheEntry, event Event) {
+	cache.mutex.Lock()
+	current := !cache.closed && cache.entries[path] == entry
+	if current {
+		delete(cache.entries, path)
+	}
+	cache.mutex.Unlock()
+	if current && event.Type == EVENT_CHANGED {
+		cache.Get(path)
+	}
+}
+
+// Close empties the cache and releases all of its watches.  Further
+// calls to Get fail with a ZCLOSING error.
+func (cache *Cache) Close() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.closed {
+		return
+	}
+	cache.closed = true
+	for path, entry := range cache.entries {
+		if entry.watched {
+			cache.conn.forgetWatch(entry.watchId)
+		}
+		delete(cache.entries, path)
+	}
+}
+
+// -----------------------------------------------------------------------
+// Ensemble configuration.
+
+// Roles an ensemble member may have, as reported in EnsembleMember.
+const (
+	ROLE_PARTICIPANT = "participant"
+	ROLE_OBSERVER    = "observer"
+)
+
+// EnsembleMember describes one server of a ZooKeeper ensemble, as
+// found in its dynamic configuration.
+type EnsembleMember struct {
+	Id           int
+	Host         string
+	PeerPort     int
+	ElectionPort int
+	Role         string
+
+	// ClientHost and ClientPort hold the address the server accepts
+	// client connections on.  ClientPort is zero if the server has no
+	// client address configured.
+	ClientHost string
+	ClientPort int
+}
+
+// GetEnsemble reads the dynamic configuration of the ensemble conn
+// is connected to from the /zookeeper/config node, and returns its
+// members along with the configuration version.
+func (conn *Conn) GetEnsemble() ([]EnsembleMember, int64, error) {
+	data, stat, err := conn.Get("/zookeeper/config")
+	if err != nil {
+		return nil, 0, err
+	}
+	members, version, err := ParseEnsemble(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version == 0 {
+		// The configuration version is the zxid of the
+		// transaction which established it.
+		version = stat.Mzxid()
+	}
+	return members, version, nil
+}
+
+// IsConnectedToObserver returns whether the server conn is currently
+// connected to is an observer of its ensemble, rather than a voting
+// participant.  The C library doesn't report the role of the server,
+// so it is found by reading the ensemble configuration as done by
+// GetEnsemble, which costs a round trip, and looking for the member
+// at the address reported by ConnectedServer.  A standalone server,
+// with no members in its configuration, isn't an observer.
+func (conn *Conn) IsConnectedToObserver() (bool, error) {
+	members, _, err := conn.GetEnsemble()
+	if err != nil {
+		return false, err
+	}
+	if len(members) == 0 {
+		return false, nil
+	}
+	member, err := findMember(members, conn.ConnectedServer())
+	if err != nil {
+		return false, err
+	}
+	return member.Role == ROLE_OBSERVER, nil
+}
+
+// findMember returns the member of the ensemble whose client address
+// is addr, an ip address and port as reported by ConnectedServer.
+func findMember(members []EnsembleMember, addr string) (EnsembleMember, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return EnsembleMember{}, fmt.Errorf("zookeeper: cannot find connected server %q in ensemble", addr)
+	}
+	for _, member := range members {
+		if strconv.Itoa(member.ClientPort) != port {
+			continue
+		}
+		memberHost := member.ClientHost
+		if ip := net.ParseIP(memberHost); ip != nil && ip.IsUnspecified() {
+			// Listening on all interfaces.
+			memberHost = member.Host
+		}
+		if sameHost(memberHost, host) {
+			return member, nil
+		}
+	}
+	return EnsembleMember{}, fmt.Errorf("zookeeper: cannot find connected server %q in ensemble", addr)
+}
+
+// sameHost returns whether host, as found in the ensemble
+// configuration, refers to the given ip address.
+func sameHost(host, ip string) bool {
+	if host == ip {
+		return true
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	if hostAddr := net.ParseIP(host); hostAddr != nil {
+		return hostAddr.Equal(addr)
+	}
+	addrs, err := net.LookupHost(host)
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if hostAddr := net.ParseIP(a); hostAddr != nil && hostAddr.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseEnsemble parses the dynamic configuration of an ensemble, in
+// the format held by the /zookeeper/config node, with one line such as
+//
+//	server.1=host:2888:3888:participant;0.0.0.0:2181
+//
+// for each member, and a "version=<hex>" line holding the
+// configuration version.  The version is zero if that line is missing.
+func ParseEnsemble(config string) (members []EnsembleMember, version int64, err error) {
+	for _, line := range strings.Split(config, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, 0, fmt.Errorf("zookeeper: invalid ensemble config line %q", line)
+		}
+		key, value := line[:i], line[i+1:]
+		switch {
+		case key == "version":
+			version, err = strconv.ParseInt(value, 16, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("zookeeper: invalid ensemble config version %q", value)
+			}
+		case strings.HasPrefix(key, "server."):
+			member, err := parseEnsembleMember(key[len("server."):], value)
+			if err != nil {
+				return nil, 0, fmt.Errorf("zookeeper: invalid ensemble config line %q: %v", line, err)
+			}
+			members = append(members, member)
+		}
+	}
+	return members, version, nil
+}
+
+func parseEnsembleMember(id, value string) (member EnsembleMember, err error) {
+	member.Id, err = strconv.Atoi(id)
+	if err != nil {
+		return member, fmt.Errorf("bad server id %q", id)
+	}
+	server, client := value, ""
+	if i := strings.Index(value, ";"); i >= 0 {
+		server, client = value[:i], value[i+1:]
+	}
+
+	host, rest, err := splitConfigHost(server)
+	if err != nil {
+		return member, err
+	}
+	fields := strings.Split(rest, ":")
+	if len(fields) < 2 || len(fields) > 3 {
+		return member, fmt.Errorf("bad server address %q", server)
+	}
+	member.Host = host
+	if member.PeerPort, err = parseConfigPort(fields[0]); err != nil {
+		return member, err
+	}
+	if member.ElectionPort, err = parseConfigPort(fields[1]); err != nil {
+		return member, err
+	}
+	member.Role = ROLE_PARTICIPANT
+	if len(fields) == 3 {
+		switch fields[2] {
+		case ROLE_PARTICIPANT, ROLE_OBSERVER:
+			member.Role = fields[2]
+		default:
+			return member, fmt.Errorf("bad server role %q", fields[2])
+		}
+	}
+
+	if client == "" {
+		return member, nil
+	}
+	// The client address may be given as a bare port.
+	member.ClientHost = "0.0.0.0"
+	port := client
+	if strings.Contains(client, ":") {
+		member.ClientHost, port, err = splitConfigHost(client)
+		if err != nil {
+			return member, err
+		}
+	}
+	member.ClientPort, err = parseConfigPort(port)
+	return member, err
+}
+
+// splitConfigHost splits addr into its host, which may be an IPv6
+// address within brackets, and the remainder following the colon
+// after the host.
+func splitConfigHost(addr string) (host, rest string, err error) {
+	if strings.HasPrefix(addr, "[") {
+		i := strings.Index(addr, "]")
+		if i < 0 || !strings.HasPrefix(addr[i+1:], ":") {
+			return "", "", fmt.Errorf("bad address %q", addr)
+		}
+		return addr[1:i], addr[i+2:], nil
 	}
-	return c, nil
+	i := strings.Index(addr, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("bad address %q", addr)
+	}
+	return addr[:i], addr[i+1:], nil
 }
 
-func (c *ClientId) Save() ([]byte, error) {
-	buf := &bytes.Buffer{}
-	err := binary.Write(buf, binary.BigEndian, c.cId)
-	if err != nil {
-		return nil, err
+func parseConfigPort(port string) (int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n <= 0 || n > 65535 {
+		return 0, fmt.Errorf("bad port %q", port)
 	}
-	return buf.Bytes(), nil
+	return n, nil
 }
 
 // -----------------------------------------------------------------------
-// RetryChange utility method.
+// Shared watches.
 
-type ChangeFunc func(oldValue string, oldStat *Stat) (newValue string, err error)
+// sharedWatchKey identifies the watches that may be shared: those
+// established on the same path by the same kind of operation.
+type sharedWatchKey struct {
+	kind, path string
+}
 
-// RetryChange runs changeFunc to attempt to atomically change path
-// in a lock free manner, and retries in case there was another
-// concurrent change between reading and writing the node.
-//
-// changeFunc must work correctly if called multiple times in case
-// the modification fails due to concurrent changes, and it may return
-// an error that will cause the the RetryChange function to stop and
-// return the same error.
-//
-// This mechanism is not suitable for a node that is frequently modified
-// concurrently. For those cases, consider using a pessimistic locking
-// mechanism.
-//
-// This is the detailed operation flow for RetryChange:
-//
-// 1. Attempt to read the node. In case the node exists, but reading it
-// fails, stop and return the error found.
-//
-// 2. Call the changeFunc with the current node value and stat,
-// or with an empty string and nil stat, if the node doesn't yet exist.
-// If the changeFunc returns an error, stop and return the same error.
-//
-// 3. If the changeFunc returns no errors, use the string returned as
-// the new candidate value for the node, and attempt to either create
-// the node, if it didn't exist, or to change its contents at the specified
-// version.  If this procedure fails due to conflicts (concurrent changes
-// in the same node), repeat from step 1.  If this procedure fails with any
-// other error, stop and return the error found.
-func (conn *Conn) RetryChange(path string, flags int, acl []ACL, changeFunc ChangeFunc) error {
+// sharedWatch is a single watch established with the server on behalf
+// of all its subscribers, whose watch ids are registered like those of
+// ordinary channel watches, without a server side counterpart.
+type sharedWatch struct {
+	// ready is closed once the attempt to establish the watch is over,
+	// and armed tells whether the attempt succeeded.
+	ready       chan struct{}
+	armed       bool
+	subscribers []uintptr
+}
+
+// SetSharedWatches enables or disables the sharing of watches on conn.
+// When enabled, concurrent calls to GetW, ChildrenW or ExistsW for the
+// same path share a single watch with the server, rather than each
+// establishing its own, and the event it delivers is fanned out to the
+// channels returned to all of them.  Every caller still gets a channel
+// of its own, which receives a single event and is closed, as usual.
+// This reduces the number of watches the server has to keep for paths
+// watched by many components.  Once a shared watch fires, the next
+// call establishes a new one.  Watches established while sharing was
+// disabled are never shared.
+func (conn *Conn) SetSharedWatches(enabled bool) {
+	conn.sharedWatchesMutex.Lock()
+	conn.shareWatches = enabled
+	conn.sharedWatchesMutex.Unlock()
+}
+
+func (conn *Conn) sharingWatches() bool {
+	conn.sharedWatchesMutex.Lock()
+	defer conn.sharedWatchesMutex.Unlock()
+	return conn.shareWatches
+}
+
+// sharedW subscribes to the shared watch of the given kind on path.  If
+// there's no such watch, arm is called to establish it, with a callback
+// to be given to the respective operation.  Otherwise fetch is called
+// to perform the same operation without a watch, so that the result it
+// returns is not older than the shared watch.
+func (conn *Conn) sharedW(kind, path string, arm func(cb func(Event)) error, fetch func() error) (<-chan Event, error) {
+	key := sharedWatchKey{kind, path}
 	for {
-		oldValue, oldStat, err := conn.Get(path)
-		if err != nil && !IsError(err, ZNONODE) {
-			return err
+		conn.sharedWatchesMutex.Lock()
+		sw := conn.sharedWatches[key]
+		if sw == nil {
+			// Subscribe before arming, since the watch may fire
+			// before arm even returns.
+			watchId, watch := conn.createWatch(false)
+			conn.describeWatch(watchId, kind, path)
+			sw = &sharedWatch{ready: make(chan struct{}), subscribers: []uintptr{watchId}}
+			if conn.sharedWatches == nil {
+				conn.sharedWatches = make(map[sharedWatchKey]*sharedWatch)
+			}
+			conn.sharedWatches[key] = sw
+			conn.sharedWatchesMutex.Unlock()
+
+			err := arm(func(event Event) { conn.fireSharedWatch(key, sw, event) })
+
+			conn.sharedWatchesMutex.Lock()
+			if err != nil {
+				if conn.sharedWatches[key] == sw {
+					delete(conn.sharedWatches, key)
+				}
+				conn.forgetWatch(watchId)
+			}
+			sw.armed = err == nil
+			close(sw.ready)
+			conn.sharedWatchesMutex.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			return watch, nil
 		}
-		newValue, err := changeFunc(oldValue, oldStat)
-		if err != nil {
-			return err
+		conn.sharedWatchesMutex.Unlock()
+
+		<-sw.ready
+		if err := fetch(); err != nil {
+			return nil, err
 		}
-		if oldStat == nil {
-			_, err := conn.Create(path, newValue, flags, acl)
-			if err == nil || !IsError(err, ZNODEEXISTS) {
-				return err
-			}
+		conn.sharedWatchesMutex.Lock()
+		if conn.sharedWatches[key] != sw || !sw.armed {
+			// The watch fired or failed in the meantime, so the
+			// result fetched might predate a change it reported.
+			conn.sharedWatchesMutex.Unlock()
 			continue
 		}
-		if newValue == oldValue {
-			return nil // Nothing to do.
-		}
-		_, err = conn.Set(path, newValue, oldStat.Version())
-		if err == nil || !IsError(err, ZBADVERSION) && !IsError(err, ZNONODE) {
-			return err
+		watchId, watch := conn.createWatch(false)
+		conn.describeWatch(watchId, kind, path)
+		sw.subscribers = append(sw.subscribers, watchId)
+		conn.sharedWatchesMutex.Unlock()
+		return watch, nil
+	}
+}
+
+// fireSharedWatch delivers the event received by the shared watch sw
+// to all its subscribers, and unregisters it so that it's not joined
+// anymore.  Subscribers closed meanwhile, as happens when conn is
+// closed, are skipped.
+func (conn *Conn) fireSharedWatch(key sharedWatchKey, sw *sharedWatch, event Event) {
+	conn.sharedWatchesMutex.Lock()
+	if conn.sharedWatches[key] == sw {
+		delete(conn.sharedWatches, key)
+	}
+	subscribers := sw.subscribers
+	sw.subscribers = nil
+	conn.sharedWatchesMutex.Unlock()
+
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	for _, watchId := range subscribers {
+		ch := conn.watchChannels[watchId]
+		if ch == nil {
+			continue
 		}
+		// Each subscriber has a fresh channel with room for the event.
+		ch <- event
+		close(ch)
+		delete(conn.watchChannels, watchId)
+		delete(watchConns, watchId)
+		delete(conn.watchRecords, watchId)
 	}
 }
 
@@ -1044,11 +5462,179 @@ func (conn *Conn) RetryChange(path string, flags int, acl []ACL, changeFunc Chan
 // entries to the event list.  When this happens, the C function returns
 // and we get back into Go land with the pointer to the watch data,
 // including the watchId and other event details such as type and path.
+//
+// Once the last connection is closed, an interrupting entry is appended
+// to the event list, which causes the goroutine to return.
+//
+// The event list and the goroutine waiting on it are shared by all
+// connections, except for those established with DialIsolated, which
+// have their own.  The C watch handler finds the event list to append
+// to via the context handed to zookeeper_init.
 
 var watchMutex sync.Mutex
 var watchConns = make(map[uintptr]*Conn)
 var watchCounter uintptr
-var watchLoopCounter int
+var watchEventSeq uint64
+
+// watchLoop holds the event list and the goroutine state
+// for dispatching watch events from the C library.
+type watchLoop struct {
+	queue    *C.watch_queue
+	counter  int
+	done     chan bool
+	isolated bool
+}
+
+// sharedWatchLoop is used by all connections not established
+// with DialIsolated.  Its queue is created on init.
+var sharedWatchLoop = &watchLoop{}
+
+func newWatchLoop() *watchLoop {
+	queue := C.create_watch_queue()
+	if queue == nil {
+		panic("Failed to create watch queue")
+	}
+	return &watchLoop{queue: queue, isolated: true}
+}
+
+var watchObserverMutex sync.Mutex
+var watchObserver func(queueDelay time.Duration)
+
+// SetWatchDispatchObserver sets a function to be called for every
+// event dispatched by a watch loop, with the time the event spent
+// queued between being received from the C library and being delivered
+// into its channel.  This helps finding out whether slow consumers are
+// holding back the delivery of events.  The observer is called from
+// the watch loop itself, so it must return quickly.  Passing nil
+// removes the observer, and no timing information is collected at
+// all while there isn't one.
+func SetWatchDispatchObserver(observer func(queueDelay time.Duration)) {
+	watchObserverMutex.Lock()
+	defer watchObserverMutex.Unlock()
+	watchObserver = observer
+	if observer != nil {
+		C.set_watch_timing(1)
+	} else {
+		C.set_watch_timing(0)
+	}
+}
+
+var watchRecoverMutex sync.Mutex
+var watchRecover func(value interface{})
+
+// SetWatchLoopRecover sets a function to be called with the value of
+// any panic raised while a watch loop dispatches an event, in which case
+// the loop carries on with the next event rather than crashing the whole
+// process.  This includes the panics raised on purpose when the buffer
+// of an event channel is full, and panics in the observer set with
+// SetWatchDispatchObserver.  Passing nil removes the handler, which is
+// the default.
+//
+// Recovering is risky: the event being dispatched is lost, and the
+// condition that caused the panic usually persists.  A session channel
+// whose buffer is full, for example, will cause a panic for every
+// event that follows until the application reads from it.  The handler
+// should at least log the panic, and arrange for the affected connection
+// to be closed if it can't be trusted anymore.
+func SetWatchLoopRecover(handler func(value interface{})) {
+	watchRecoverMutex.Lock()
+	defer watchRecoverMutex.Unlock()
+	watchRecover = handler
+}
+
+var backpressureHandlerMutex sync.Mutex
+var backpressureHandler func(conn *Conn, pending, capacity int)
+
+// SetBackpressureHandler sets a function to be called whenever an event
+// is delivered to the session channel of a connection while the channel
+// buffer is at least 75% full, with the number of events pending in the
+// buffer and its capacity.  A completely full buffer is fatal, so this
+// is an early warning that the application is falling behind in reading
+// session events, which may be used to raise alerts or shed load.  The
+// warning is advisory only: nothing else changes when it's issued.  The
+// handler is called in a goroutine of its own, so it doesn't hold back
+// the delivery of events.  Passing nil removes the handler.
+func SetBackpressureHandler(handler func(conn *Conn, pending, capacity int)) {
+	backpressureHandlerMutex.Lock()
+	backpressureHandler = handler
+	backpressureHandlerMutex.Unlock()
+}
+
+// notifyBackpressure calls the backpressure handler, if there's one.
+func notifyBackpressure(conn *Conn, pending, capacity int) {
+	getLogger().Warnf("zookeeper: connection %s: %d of %d session events pending", conn.id, pending, capacity)
+	backpressureHandlerMutex.Lock()
+	handler := backpressureHandler
+	backpressureHandlerMutex.Unlock()
+	if handler != nil {
+		go handler(conn, pending, capacity)
+	}
+}
+
+// sessionEvent is a session event queued for the global session handler.
+type sessionEvent struct {
+	conn  *Conn
+	event Event
+}
+
+var sessionHandlerMutex sync.Mutex
+var sessionHandlerCond = sync.NewCond(&sessionHandlerMutex)
+var sessionHandler func(conn *Conn, event Event)
+var sessionHandlerQueue []sessionEvent
+var sessionHandlerRunning bool
+
+// SetGlobalSessionHandler sets a function to be called for every
+// session event received by any connection, in addition to the event
+// being delivered to the session channel returned when dialing.  This
+// offers a central point for logging or collecting metrics about all
+// sessions in the process, where conn.Id tells apart the connections
+// the events come from.  The handler is called from a goroutine of
+// its own, one event at a time and in the order the events were
+// dispatched, so the events of each connection are seen in order.  A
+// slow handler doesn't hold back the delivery of events, but it does
+// delay its own later calls.  Passing nil removes the handler, and
+// events still queued for it are dropped.
+func SetGlobalSessionHandler(handler func(conn *Conn, event Event)) {
+	sessionHandlerMutex.Lock()
+	defer sessionHandlerMutex.Unlock()
+	sessionHandler = handler
+	if handler == nil {
+		sessionHandlerQueue = nil
+	} else if !sessionHandlerRunning {
+		sessionHandlerRunning = true
+		go runSessionHandler()
+	}
+}
+
+// queueSessionEvent queues event received by conn
+// for the global session handler, if there's one.
+func queueSessionEvent(conn *Conn, event Event) {
+	sessionHandlerMutex.Lock()
+	defer sessionHandlerMutex.Unlock()
+	if sessionHandler != nil {
+		sessionHandlerQueue = append(sessionHandlerQueue, sessionEvent{conn, event})
+		sessionHandlerCond.Signal()
+	}
+}
+
+// runSessionHandler calls the global session handler with the
+// queued events, waiting for more when the queue is empty.
+func runSessionHandler() {
+	sessionHandlerMutex.Lock()
+	for {
+		for len(sessionHandlerQueue) == 0 {
+			sessionHandlerCond.Wait()
+		}
+		e := sessionHandlerQueue[0]
+		sessionHandlerQueue = sessionHandlerQueue[1:]
+		handler := sessionHandler
+		sessionHandlerMutex.Unlock()
+		if handler != nil {
+			handler(e.conn, e.event)
+		}
+		sessionHandlerMutex.Lock()
+	}
+}
 
 // CountPendingWatches returns the number of pending watches which have
 // not been fired yet, across all ZooKeeper instances.  This is useful
@@ -1060,6 +5646,249 @@ func CountPendingWatches() int {
 	return count
 }
 
+// WatchPending returns whether watch, as returned by one of the *W
+// methods of conn, is still waiting for its event to be delivered.
+// It returns false once the event has been delivered, or if watch
+// wasn't obtained from conn.
+func (conn *Conn) WatchPending(watch <-chan Event) bool {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	for _, ch := range conn.watchChannels {
+		if ch == watch {
+			return true
+		}
+	}
+	return false
+}
+
+// PendingWatches returns the number of watches established through
+// conn which have not been fired yet, not counting the session watch.
+func (conn *Conn) PendingWatches() int {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	count := len(conn.watchChannels) + len(conn.watchCallbacks)
+	if _, ok := conn.watchChannels[conn.sessionWatchId]; ok {
+		count--
+	}
+	return count
+}
+
+// WatchInfo describes a pending watch, as reported by DebugWatches.
+type WatchInfo struct {
+	Path string
+	Kind string        // One of "get", "exists", "children" or "persistent".
+	Age  time.Duration // Time elapsed since the watch was established.
+}
+
+// DebugWatches describes the watches established through conn which
+// have not been fired yet, ordered by path and kind.  It's meant for
+// tracking down leaked watches, which PendingWatches only counts.
+func (conn *Conn) DebugWatches() []WatchInfo {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	now := time.Now()
+	var watches []WatchInfo
+	for _, record := range conn.watchRecords {
+		watches = append(watches, WatchInfo{record.path, record.kind, now.Sub(record.created)})
+	}
+	sort.Slice(watches, func(i, j int) bool {
+		if watches[i].Path != watches[j].Path {
+			return watches[i].Path < watches[j].Path
+		}
+		return watches[i].Kind < watches[j].Kind
+	})
+	return watches
+}
+
+// ReconnectCount returns the number of times the session established
+// by conn was connected again after losing its connection to the
+// server.  A count that keeps climbing indicates an unstable link.
+func (conn *Conn) ReconnectCount() int64 {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	return conn.reconnects
+}
+
+// qualityWindow is the period covered by QualityReport.ReconnectsLastMinute,
+// and qualityPings the number of pings averaged in QualityReport.AvgPingRTT.
+const (
+	qualityWindow = time.Minute
+	qualityPings  = 10
+)
+
+// QualityReport describes how well the connection of a Conn has been
+// doing recently, as returned by Conn.Quality.
+type QualityReport struct {
+	// ReconnectsLastMinute is the number of times the session was
+	// connected again after losing its connection in the last minute.
+	ReconnectsLastMinute int
+
+	// AvgPingRTT is the average round trip time of the latest pings,
+	// either made in the background as set with Conn.SetPingInterval
+	// or with Conn.Ping, or zero if none succeeded yet.
+	AvgPingRTT time.Duration
+
+	// LastDisconnectAgo is the time elapsed since the connection was
+	// last lost, or zero if it never was.
+	LastDisconnectAgo time.Duration
+}
+
+// Quality reports how well the connection of conn has been doing
+// recently, which tells apart a flaky connection from a healthy one even
+// while it happens to be connected.  Round trip times are only measured
+// by pings, so applications interested in them should enable background
+// pings with SetPingInterval, or call Ping themselves.
+func (conn *Conn) Quality() QualityReport {
+	var report QualityReport
+	conn.pingMutex.Lock()
+	if len(conn.pingRTTs) > 0 {
+		var total time.Duration
+		for _, rtt := range conn.pingRTTs {
+			total += rtt
+		}
+		report.AvgPingRTT = total / time.Duration(len(conn.pingRTTs))
+	}
+	conn.pingMutex.Unlock()
+
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	now := time.Now()
+	conn.pruneReconnects(now)
+	report.ReconnectsLastMinute = len(conn.recentReconnects)
+	if !conn.lostAt.IsZero() {
+		report.LastDisconnectAgo = now.Sub(conn.lostAt)
+	}
+	return report
+}
+
+// SetPingInterval makes conn ping the server in the background every
+// interval, as Ping does, so that the round trip time in the report
+// returned by Quality is kept up to date.  An interval of zero, the
+// default, stops the pings, which also stop once conn is closed.
+func (conn *Conn) SetPingInterval(interval time.Duration) {
+	conn.pingMutex.Lock()
+	defer conn.pingMutex.Unlock()
+	if conn.pingStop != nil {
+		close(conn.pingStop)
+		conn.pingStop = nil
+	}
+	if interval > 0 {
+		conn.pingStop = make(chan struct{})
+		go conn.pingLoop(interval, conn.pingStop)
+	}
+}
+
+// pingLoop pings the server every interval until stop is closed.
+func (conn *Conn) pingLoop(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if _, err := conn.Ping(); IsError(err, ZCLOSING) {
+			return
+		}
+	}
+}
+
+// pruneReconnects forgets the reconnections that happened before
+// the last qualityWindow.  It must be called with watchMutex held.
+func (conn *Conn) pruneReconnects(now time.Time) {
+	i := 0
+	for i < len(conn.recentReconnects) && now.Sub(conn.recentReconnects[i]) >= qualityWindow {
+		i++
+	}
+	conn.recentReconnects = conn.recentReconnects[i:]
+}
+
+// SessionTimeRemaining estimates how long the session established by
+// conn would survive if the connection were lost right now, which is
+// the whole session timeout while connected.  While the connection is
+// lost, the time elapsed since the client last heard from the server
+// is taken off.  That's when an operation last got a reply, or when the
+// connection was established, whichever happened last, but no earlier
+// than two thirds of the session timeout before the loss was noticed:
+// the C library pings an idle server every third of the timeout, and
+// only reports the connection as lost after two thirds of it went by
+// without hearing from the server.  It returns zero if conn is closed,
+// its session has expired, or it was never established.
+//
+// The server starts counting from the last time it heard from the
+// client, which is no earlier than the last reply the client got, so
+// the estimate errs on the safe side, though the clocks of the client
+// and the server don't advance in lockstep.  Decisions such as whether
+// to keep holding a lock after a blip should still leave a safety
+// margin.
+func (conn *Conn) SessionTimeRemaining() time.Duration {
+	if conn.IsUnrecoverable() {
+		return 0
+	}
+	timeout := conn.RecvTimeout()
+	conn.breaker.mutex.Lock()
+	lastReply := conn.breaker.lastReply
+	conn.breaker.mutex.Unlock()
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	if timeout == 0 || !conn.everConnected {
+		return 0
+	}
+	if !conn.lostConnection {
+		return timeout
+	}
+	lastHeard := conn.connectedAt
+	if lastReply.After(lastHeard) {
+		lastHeard = lastReply
+	}
+	if lastPing := conn.lostAt.Add(-2 * timeout / 3); lastPing.After(lastHeard) {
+		lastHeard = lastPing
+	}
+	if remaining := timeout - time.Since(lastHeard); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// logSessionEvent reports a session event to the logger.  It must be
+// called with watchMutex held, after trackReconnects.
+func (conn *Conn) logSessionEvent(event Event, reconnected bool) {
+	log := getLogger()
+	switch {
+	case event.State == STATE_EXPIRED_SESSION || event.State == STATE_AUTH_FAILED:
+		log.Errorf("zookeeper: connection %s: %v", conn.id, event)
+	case reconnected:
+		log.Infof("zookeeper: connection %s: reconnected (%d reconnections so far)", conn.id, conn.reconnects)
+	case conn.lostConnection && event.State == STATE_CONNECTING:
+		log.Warnf("zookeeper: connection %s: connection lost", conn.id)
+	default:
+		log.Debugf("zookeeper: connection %s: %v", conn.id, event)
+	}
+}
+
+// trackReconnects updates the count of reconnections with the
+// state of a session event.  It must be called with watchMutex held.
+func (conn *Conn) trackReconnects(state int) {
+	switch state {
+	case STATE_CONNECTED:
+		if conn.lostConnection {
+			conn.reconnects++
+			now := time.Now()
+			conn.pruneReconnects(now)
+			conn.recentReconnects = append(conn.recentReconnects, now)
+		}
+		conn.everConnected = true
+		conn.lostConnection = false
+		conn.connectedAt = time.Now()
+	case STATE_CONNECTING, STATE_ASSOCIATING:
+		if conn.everConnected && !conn.lostConnection {
+			conn.lostAt = time.Now()
+		}
+		conn.lostConnection = conn.everConnected
+	}
+}
+
 // createWatch creates and registers a watch, returning the watch id
 // and channel.
 func (conn *Conn) createWatch(session bool) (watchId uintptr, watchChannel chan Event) {
@@ -1077,6 +5906,72 @@ func (conn *Conn) createWatch(session bool) (watchId uintptr, watchChannel chan
 	return
 }
 
+// createCallbackWatch registers a watch which delivers its event
+// by calling cb, and returns its watch id.
+func (conn *Conn) createCallbackWatch(cb func(Event)) (watchId uintptr) {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	watchId = watchCounter
+	watchCounter += 1
+	conn.watchCallbacks[watchId] = cb
+	watchConns[watchId] = conn
+	return
+}
+
+// newWatch registers a watch of the given kind on path, which delivers
+// its event to cb if it's not nil, or otherwise to the returned channel.
+// Unless the watch is the one shared by the subscribers of a shared
+// watch, which are listed in its place, it's recorded for DebugWatches.
+func (conn *Conn) newWatch(kind, path string, cb func(Event), shared bool) (watchId uintptr, watchChannel <-chan Event) {
+	if cb != nil {
+		watchId = conn.createCallbackWatch(cb)
+	} else {
+		watchId, watchChannel = conn.createWatch(true)
+	}
+	if !shared {
+		conn.describeWatch(watchId, kind, path)
+	}
+	return watchId, watchChannel
+}
+
+// watchRecord describes a watch for DebugWatches.
+type watchRecord struct {
+	kind, path string
+	created    time.Time
+}
+
+// describeWatch records the kind and path of watchId for DebugWatches.
+func (conn *Conn) describeWatch(watchId uintptr, kind, path string) {
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	if _, ok := watchConns[watchId]; !ok {
+		// Fired or forgotten already.
+		return
+	}
+	if conn.watchRecords == nil {
+		conn.watchRecords = make(map[uintptr]watchRecord)
+	}
+	conn.watchRecords[watchId] = watchRecord{kind, path, time.Now()}
+}
+
+// createPersistentWatch creates and registers a watch which delivers
+// every event it receives, rather than just the first one, returning
+// the watch id and channel.
+func (conn *Conn) createPersistentWatch() (watchId uintptr, watchChannel chan Event) {
+	watchChannel = make(chan Event, 32)
+	watchMutex.Lock()
+	defer watchMutex.Unlock()
+	watchId = watchCounter
+	watchCounter += 1
+	conn.watchChannels[watchId] = watchChannel
+	if conn.persistentWatches == nil {
+		conn.persistentWatches = make(map[uintptr]bool)
+	}
+	conn.persistentWatches[watchId] = true
+	watchConns[watchId] = conn
+	return
+}
+
 // forgetWatch cleans resources used by watchId and prevents it
 // from ever getting delivered. It shouldn't be used if there's any
 // chance the watch channel is still visible and not closed, since
@@ -1085,17 +5980,58 @@ func (conn *Conn) forgetWatch(watchId uintptr) {
 	watchMutex.Lock()
 	defer watchMutex.Unlock()
 	delete(conn.watchChannels, watchId)
+	delete(conn.watchCallbacks, watchId)
+	delete(conn.persistentWatches, watchId)
 	delete(watchConns, watchId)
+	delete(conn.watchRecords, watchId)
 }
 
-// closeAllWatches closes all watch channels for conn.
-func (conn *Conn) closeAllWatches() {
+// closeAllWatches closes all watch channels for conn, delivering
+// a final STATE_CLOSED event with the given reason right before
+// each channel is closed.
+func (conn *Conn) closeAllWatches(reason int) {
 	watchMutex.Lock()
 	defer watchMutex.Unlock()
+	conn.closeAllWatchesLocked(reason)
+}
+
+// SetInjectClosedEvent determines whether an EVENT_CLOSED event, with
+// State set to STATE_CLOSED and the reason in CloseReason, is delivered
+// on the session and watch channels of conn right before they're closed.
+// It is by default, which lets the application tell apart why the
+// channel was closed.  Disabling it suits consumers that range over the
+// channels, which then just end.  Callbacks registered for watches are
+// still called with the event, as they have no channel to close.
+func (conn *Conn) SetInjectClosedEvent(inject bool) {
+	watchMutex.Lock()
+	conn.omitClosedEvent = !inject
+	watchMutex.Unlock()
+}
+
+// closeAllWatchesLocked is like closeAllWatches, but must
+// be called with watchMutex held.
+func (conn *Conn) closeAllWatchesLocked(reason int) {
+	event := Event{Type: EVENT_CLOSED, State: STATE_CLOSED, CloseReason: reason}
 	for watchId, ch := range conn.watchChannels {
+		if !conn.omitClosedEvent {
+			select {
+			case ch <- event:
+			default:
+				// The session channel buffer is full. The application
+				// will observe the zeroed event from the closed channel.
+			}
+		}
 		close(ch)
 		delete(conn.watchChannels, watchId)
+		delete(conn.persistentWatches, watchId)
+		delete(watchConns, watchId)
+		delete(conn.watchRecords, watchId)
+	}
+	for watchId, cb := range conn.watchCallbacks {
+		go cb(event)
+		delete(conn.watchCallbacks, watchId)
 		delete(watchConns, watchId)
+		delete(conn.watchRecords, watchId)
 	}
 }
 
@@ -1108,10 +6044,27 @@ func sendEvent(watchId uintptr, event Event) {
 	}
 	watchMutex.Lock()
 	defer watchMutex.Unlock()
+	watchEventSeq++
+	event.Seq = watchEventSeq
 	conn, ok := watchConns[watchId]
 	if !ok {
 		return
 	}
+	if event.Type == EVENT_SESSION && event.State == STATE_AUTH_FAILED {
+		// Called with watchMutex held, so there's no risk
+		// of closing the channel twice.
+		select {
+		case <-conn.authFailed:
+		default:
+			close(conn.authFailed)
+		}
+	}
+	if event.Type == EVENT_SESSION && watchId == conn.sessionWatchId {
+		reconnects := conn.reconnects
+		conn.trackReconnects(event.State)
+		conn.logSessionEvent(event, conn.reconnects > reconnects)
+		queueSessionEvent(conn, event)
+	}
 	if event.Type == EVENT_SESSION && watchId != conn.sessionWatchId {
 		// All session events on non-session watches will be delivered
 		// and cause the watch to be closed early. We purposefully do
@@ -1125,6 +6078,30 @@ func sendEvent(watchId uintptr, event Event) {
 			// Make the intent more clear by tweaking the code.
 			event.State = STATE_CONNECTING
 		}
+		if event.State == STATE_EXPIRED_SESSION {
+			event.CloseReason = CLOSE_SESSION_EXPIRED
+		} else {
+			event.CloseReason = CLOSE_SESSION_EVENT
+		}
+	}
+	if event.Type == EVENT_NOTWATCHING {
+		if watchId == conn.sessionWatchId {
+			// Not a watch the application has established,
+			// and the session channel must stay open.
+			return
+		}
+		// The watch is dead, so it's freed below like a fired
+		// one, but flagged so that it's not mistaken for one.
+		event.CloseReason = CLOSE_NOT_WATCHING
+	}
+	if cb := conn.watchCallbacks[watchId]; cb != nil {
+		// Run the callback in a goroutine of its own so
+		// that it can't hold back the watch loop.
+		delete(conn.watchCallbacks, watchId)
+		delete(watchConns, watchId)
+		delete(conn.watchRecords, watchId)
+		go cb(event)
+		return
 	}
 	ch := conn.watchChannels[watchId]
 	if ch == nil {
@@ -1133,11 +6110,26 @@ func sendEvent(watchId uintptr, event Event) {
 	select {
 	case ch <- event:
 	default:
+		if conn.persistentWatches[watchId] {
+			// The application isn't keeping up with the events
+			// of a persistent watch.  Only the watch is affected.
+			delete(conn.watchChannels, watchId)
+			delete(conn.persistentWatches, watchId)
+			delete(watchConns, watchId)
+			delete(conn.watchRecords, watchId)
+			close(ch)
+			return
+		}
 		// Channel not available for sending, which means session
 		// events are necessarily involved (trivial events go
 		// straight to the buffer), and the application isn't paying
 		// attention for long enough to have the buffer filled up.
 		// Break down now rather than leaking forever.
+		if conn.watchLoop.isolated {
+			// Only this connection is affected.
+			conn.closeAllWatchesLocked(CLOSE_BUFFER_FULL)
+			return
+		}
 		if watchId == conn.sessionWatchId {
 			panic("Session event channel buffer is full")
 		} else {
@@ -1145,53 +6137,107 @@ func sendEvent(watchId uintptr, event Event) {
 		}
 	}
 	if watchId != conn.sessionWatchId {
+		if conn.persistentWatches[watchId] && event.Ok() {
+			// Persistent watches stay around until
+			// something goes wrong.
+			return
+		}
 		delete(conn.watchChannels, watchId)
+		delete(conn.persistentWatches, watchId)
 		delete(watchConns, watchId)
+		delete(conn.watchRecords, watchId)
 		close(ch)
+		return
+	}
+	if pending, capacity := len(ch), cap(ch); pending*4 >= capacity*3 {
+		notifyBackpressure(conn, pending, capacity)
 	}
 }
 
-// runWatchLoop start the event loop to collect events from the C
-// library and dispatch them into Go land.  Calling this function
+// run starts the event loop to collect events from the C
+// library and dispatch them into Go land.  Calling this method
 // multiple times will only increase a counter, rather than
 // getting multiple watch loops running.
-func runWatchLoop() {
+func (loop *watchLoop) run() {
 	watchMutex.Lock()
-	if watchLoopCounter == 0 {
-		go _watchLoop()
+	if loop.counter == 0 {
+		// A previous loop may still be draining events queued
+		// before it was interrupted, so the new loop waits for
+		// it to finish in order to preserve the event ordering.
+		previous := loop.done
+		loop.done = make(chan bool)
+		go loop._watchLoop(previous, loop.done)
 	}
-	watchLoopCounter += 1
+	loop.counter += 1
 	watchMutex.Unlock()
 }
 
-// stopWatchLoop decrements the event loop counter. For the moment,
-// the event loop doesn't actually stop, but some day we can easily
-// implement termination of the loop if necessary.
-func stopWatchLoop() {
+// stop decrements the event loop counter, and interrupts
+// the event loop once no connections remain using it.
+func (loop *watchLoop) stop() {
 	watchMutex.Lock()
-	watchLoopCounter -= 1
-	if watchLoopCounter == 0 {
-		// Not really stopping right now, so let's just
-		// avoid it from running again.
-		watchLoopCounter += 1
+	loop.counter -= 1
+	if loop.counter == 0 {
+		C.interrupt_watch(loop.queue)
 	}
 	watchMutex.Unlock()
 }
 
 // Loop and block in a C call waiting for a watch to be fired.  When
 // it fires, handle the watch by dispatching it to the correct event
-// channel, and go back onto waiting mode.
-func _watchLoop() {
+// channel, and go back onto waiting mode.  The loop only starts once
+// the previous channel is closed, if it's not nil, and closes the done
+// channel when interrupted by stop.  An isolated loop is never run
+// again, so its queue is destroyed at that point.
+func (loop *watchLoop) _watchLoop(previous, done chan bool) {
+	if previous != nil {
+		<-previous
+	}
+	defer close(done)
 	for {
 		// This will block until there's a watch event is available.
-		data := C.wait_for_watch()
+		data := C.wait_for_watch(loop.queue)
+		if data.interrupt != 0 {
+			C.destroy_watch_data(data)
+			if loop.isolated {
+				C.destroy_watch_queue(loop.queue)
+			}
+			return
+		}
 		event := Event{
 			Type:  int(data.event_type),
 			Path:  C.GoString(data.event_path),
 			State: int(data.connection_state),
 		}
 		watchId := uintptr(data.watch_context)
+		enqueued := int64(data.enqueued_ns)
 		C.destroy_watch_data(data)
-		sendEvent(watchId, event)
+		dispatchEvent(watchId, event, enqueued)
+	}
+}
+
+// dispatchEvent delivers event to watchId, and reports how long it was
+// queued for to the dispatch observer if it was timed.  Panics are
+// recovered if a handler was set with SetWatchLoopRecover.
+func dispatchEvent(watchId uintptr, event Event, enqueued int64) {
+	watchRecoverMutex.Lock()
+	handler := watchRecover
+	watchRecoverMutex.Unlock()
+	if handler != nil {
+		defer func() {
+			if value := recover(); value != nil {
+				getLogger().Errorf("zookeeper: watch loop recovered from panic: %v", value)
+				handler(value)
+			}
+		}()
+	}
+	sendEvent(watchId, event)
+	if enqueued != 0 {
+		watchObserverMutex.Lock()
+		observer := watchObserver
+		watchObserverMutex.Unlock()
+		if observer != nil {
+			observer(time.Duration(int64(C.monotonic_ns()) - enqueued))
+		}
 	}
 }